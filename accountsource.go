@@ -0,0 +1,173 @@
+package cm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jwtv2 "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultAccountLookupSubject is the subject a NATS server with a full
+// account resolver answers account JWT lookups on
+const DefaultAccountLookupSubject = "$SYS.REQ.ACCOUNT.%s.CLAIMS.LOOKUP"
+
+// ErrUnregisteredSigningKey is returned for generator configurations
+// using signing keys that the account JWT doesn't list
+var ErrUnregisteredSigningKey = errors.New("signing key is not registered with the account")
+
+// AccountJwtSource looks up account JWTs
+type AccountJwtSource interface {
+	// GetAccountJwt returns the JWT for the account or nil if not found
+	GetAccountJwt(account string) ([]byte, error)
+}
+
+// NewAccountJwtSource returns the source described by the spec: a URL
+// starting with `http://` or `https://`, `nats` or `nats:<subject>`
+// to request JWTs over the connection, or else a directory.
+func NewAccountJwtSource(spec string, nc *nats.Conn) (AccountJwtSource, error) {
+	switch {
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return NewURLAccountSource(spec), nil
+	case spec == "nats" || strings.HasPrefix(spec, "nats:"):
+		return NewNatsAccountSource(nc, strings.TrimPrefix(strings.TrimPrefix(spec, "nats"), ":")), nil
+	default:
+		return NewDirAccountSource(spec)
+	}
+}
+
+// DirAccountSource reads account JWTs from files named after the
+// account, optionally with a `.jwt` extension
+type DirAccountSource struct {
+	dir string
+}
+
+func NewDirAccountSource(dir string) (*DirAccountSource, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &DirAccountSource{dir: dir}, nil
+}
+
+func (s *DirAccountSource) GetAccountJwt(account string) ([]byte, error) {
+	account = strings.ToUpper(account)
+	for _, n := range []string{account + ".jwt", account} {
+		d, err := os.ReadFile(filepath.Join(s.dir, n))
+		if err == nil {
+			return []byte(strings.TrimSpace(string(d))), nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// NatsAccountSource requests account JWTs over NATS. The subject
+// has a `%s` where the account goes.
+type NatsAccountSource struct {
+	nc      *nats.Conn
+	subject string
+	timeout time.Duration
+}
+
+func NewNatsAccountSource(nc *nats.Conn, subject string) *NatsAccountSource {
+	if subject == "" {
+		subject = DefaultAccountLookupSubject
+	}
+	return &NatsAccountSource{nc: nc, subject: subject, timeout: 2 * time.Second}
+}
+
+func (s *NatsAccountSource) GetAccountJwt(account string) ([]byte, error) {
+	m, err := s.nc.Request(fmt.Sprintf(s.subject, strings.ToUpper(account)), nil, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Data) == 0 {
+		return nil, nil
+	}
+	return m.Data, nil
+}
+
+// URLAccountSource fetches account JWTs over HTTP. The account replaces
+// a `%s` in the URL, or is appended as the last path element.
+type URLAccountSource struct {
+	url    string
+	client http.Client
+}
+
+func NewURLAccountSource(url string) *URLAccountSource {
+	return &URLAccountSource{url: url, client: http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *URLAccountSource) GetAccountJwt(account string) ([]byte, error) {
+	account = strings.ToUpper(account)
+	u := strings.TrimSuffix(s.url, "/") + "/" + account
+	if strings.Contains(s.url, "%s") {
+		u = fmt.Sprintf(s.url, account)
+	}
+	r, err := s.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s returned %s", u, r.Status)
+	}
+	d, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(string(d))), nil
+}
+
+// accountClaims looks up and decodes the JWT for the account
+func accountClaims(account string, src AccountJwtSource) (*jwtv2.AccountClaims, error) {
+	d, err := src.GetAccountJwt(account)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up account %s: %v", account, err)
+	}
+	if d == nil {
+		return nil, fmt.Errorf("account %s not found", account)
+	}
+	ac, err := jwtv2.DecodeAccountClaims(string(d))
+	if err != nil {
+		return nil, err
+	}
+	if ac.Subject != account {
+		return nil, fmt.Errorf("account JWT is for %s", ac.Subject)
+	}
+	return ac, nil
+}
+
+// checkSigningKeys verifies that the generator signing keys of the
+// configuration are registered in the account JWT
+func checkSigningKeys(c *Config, ac *jwtv2.AccountClaims) error {
+	if c.Kind != Generator || c.GeneratorConfig == nil {
+		return nil
+	}
+	for _, r := range c.GeneratorConfig.Roles {
+		pk, err := r.PublicKey()
+		if err != nil {
+			return err
+		}
+		if !ac.SigningKeys.Contains(pk) {
+			return fmt.Errorf("role %s: %w", r.Role.String(), ErrUnregisteredSigningKey)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package cm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jwtv2 "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// accountJwt returns an account JWT registering the signing keys of the roles
+func accountJwt(t *testing.T, ts *CredentialsTestSetup, akp nkeys.KeyPair, roles ...RolePerms) string {
+	okp, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	return signedAccountJwt(t, ts, akp, okp, roles...)
+}
+
+// signedAccountJwt returns an account JWT issued by the operator key
+func signedAccountJwt(t *testing.T, ts *CredentialsTestSetup, akp nkeys.KeyPair, okp nkeys.KeyPair, roles ...RolePerms) string {
+	ac := jwtv2.NewAccountClaims(ts.PublicKey(t, akp))
+	for _, r := range roles {
+		kp, err := r.KeyPair()
+		require.NoError(t, err)
+		ac.SigningKeys.Add(ts.PublicKey(t, kp))
+	}
+	token, err := ac.Encode(okp)
+	require.NoError(t, err)
+	return token
+}
+
+func TestAccountJwtSources(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	token := accountJwt(t, ts, akp)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, apk+".jwt"), []byte(token+"\n"), 0600))
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/"+apk) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(token))
+	}))
+	defer hs.Close()
+	nc := ts.NatsClient(t, "accounts")
+	_, err := nc.Subscribe("accounts.*", func(m *nats.Msg) {
+		if strings.HasSuffix(m.Subject, apk) {
+			m.Respond([]byte(token))
+		} else {
+			m.Respond(nil)
+		}
+	})
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	for _, spec := range []string{dir, hs.URL + "/jwt/v1/accounts", hs.URL + "/jwt/v1/accounts/%s", "nats:accounts.%s"} {
+		src, err := NewAccountJwtSource(spec, ts.NatsClient(t, "cm"))
+		require.NoError(t, err, spec)
+		d, err := src.GetAccountJwt(strings.ToLower(apk))
+		require.NoError(t, err, spec)
+		require.Equal(t, token, string(d), spec)
+		d, err = src.GetAccountJwt(ts.PublicKey(t, ts.CreateAccountPair(t)))
+		require.NoError(t, err, spec)
+		require.Nil(t, d, spec)
+	}
+	_, err = NewAccountJwtSource(filepath.Join(dir, "missing"), nil)
+	require.Error(t, err)
+}
+
+func TestBackendRejectsUnregisteredSigningKeys(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	gc := rc.OptionsAsGeneratorConfig()
+
+	dir := t.TempDir()
+	be := NewBackend(NewMemoryStore())
+	src, err := NewDirAccountSource(dir)
+	require.NoError(t, err)
+	be.SetAccountJwtSource(src)
+	require.NoError(t, be.Start())
+
+	// unknown account
+	config := ts.EncodeResolverConfig(t, rc, akp)
+	require.Error(t, be.UpdateAccountConfig([]byte(config)))
+
+	// only some of the keys are registered
+	fp := filepath.Join(dir, ts.PublicKey(t, akp))
+	require.NoError(t, os.WriteFile(fp, []byte(accountJwt(t, ts, akp, gc.Roles[0])), 0600))
+	err = be.UpdateAccountConfig([]byte(config))
+	require.ErrorIs(t, err, ErrUnregisteredSigningKey)
+
+	require.NoError(t, os.WriteFile(fp, []byte(accountJwt(t, ts, akp, gc.Roles...)), 0600))
+	require.NoError(t, be.UpdateAccountConfig([]byte(config)))
+
+	// static configurations don't have signing keys
+	skp := ts.CreateAccountPair(t)
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, ts.CreateResolverConfig(t, Static), skp))))
+}
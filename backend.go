@@ -1,28 +1,178 @@
 package cm
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/nats-io/jwt"
+	"github.com/nats-io/nkeys"
 )
 
 type Backend struct {
-	sr       *StaticFileResolver
-	dir      string
+	sr       Store
 	accounts *AccountCache
+	// serializes configuration updates so the cache matches the store
+	locks KeyLocks
+	// verifies generator signing keys if set
+	accountJwts AccountJwtSource
+	// verifies the account issuer if set
+	operators *TrustedOperators
+	// opens sealed generator signing keys
+	curve nkeys.KeyPair
+	// signs with external generator signing keys
+	signer Signer
+	// single use configuration request tokens
+	requests *Nonces
 }
 
-func NewBackend(dir string) *Backend {
-	b := Backend{dir: dir}
+// MaxRequestTTL is the longest a configuration request token can be
+// valid for
+const MaxRequestTTL = 5 * time.Minute
+
+// ErrInvalidRequest is returned for configuration request tokens that
+// are of the wrong type, carry data, don't expire soon enough, have
+// expired or were already used
+var ErrInvalidRequest = errors.New("invalid configuration request")
+
+func NewBackend(store Store) *Backend {
+	b := Backend{sr: store}
 	b.accounts = NewAccountCache()
+	b.requests = NewNonces(MaxRequestTTL)
 	return &b
 }
 
+// SetAccountJwtSource sets the source of account JWTs used to verify
+// that generator signing keys are registered with the account
+func (s *Backend) SetAccountJwtSource(src AccountJwtSource) {
+	s.accountJwts = src
+}
+
+// SetTrustedOperators restricts configurations to accounts issued by
+// the operators. It requires an account JWT source.
+func (s *Backend) SetTrustedOperators(operators *TrustedOperators) {
+	s.operators = operators
+}
+
+// SetCurveKey sets the curve key that generator signing keys can be
+// sealed for
+func (s *Backend) SetCurveKey(kp nkeys.KeyPair) {
+	s.curve = kp
+}
+
+// SetSigner sets the signer of external generator signing keys
+func (s *Backend) SetSigner(signer Signer) {
+	s.signer = signer
+}
+
+// checkRoleKeys verifies that sealed generator signing keys can be
+// opened with the curve key, and that there's a signer for external keys
+func (s *Backend) checkRoleKeys(token []byte) error {
+	c, err := parseConfig(token)
+	if err != nil {
+		return err
+	}
+	if c.Kind != Generator || c.GeneratorConfig == nil {
+		return nil
+	}
+	for _, r := range c.GeneratorConfig.Roles {
+		if r.ExternalSigningKey != nil && s.signer == nil {
+			return fmt.Errorf("role %s: %w", r.Role.String(), ErrNoSigner)
+		}
+		if r.SealedSigningKey == nil {
+			continue
+		}
+		kp, err := r.SealedSigningKey.Open(s.curve)
+		if err != nil {
+			return fmt.Errorf("role %s: %w: %v", r.Role.String(), ErrSealedSigningKey, err)
+		}
+		kp.Wipe()
+	}
+	return nil
+}
+
+// verifyAccount checks the account JWT of the configuration: that it
+// was issued by a trusted operator if set, and that it registers the
+// generator signing keys if an account JWT source is set
+func (s *Backend) verifyAccount(token []byte) error {
+	if s.accountJwts == nil {
+		if s.operators != nil {
+			return errors.New("trusted operators require an account JWT source")
+		}
+		return nil
+	}
+	c, err := parseConfig(token)
+	if err != nil {
+		return err
+	}
+	// static configurations have no signing keys to verify
+	if s.operators == nil && c.Kind != Generator {
+		return nil
+	}
+	ac, err := accountClaims(c.Account, s.accountJwts)
+	if err != nil {
+		return err
+	}
+	if s.operators != nil {
+		if err := s.operators.Check(ac); err != nil {
+			return err
+		}
+	}
+	return checkSigningKeys(c, ac)
+}
+
+// checkTrust verifies the account of a stored configuration is issued
+// by a trusted operator if set, as configurations stored before the
+// operators were set, or whose account was reissued, were never checked
+func (s *Backend) checkTrust(c *Config) error {
+	if s.operators == nil {
+		return nil
+	}
+	if s.accountJwts == nil {
+		return errors.New("trusted operators require an account JWT source")
+	}
+	ac, err := accountClaims(c.Account, s.accountJwts)
+	if err != nil {
+		return err
+	}
+	return s.operators.Check(ac)
+}
+
 func (s *Backend) Start() error {
-	var err error
-	s.sr, err = NewStaticResolver(s.dir)
-	return err
+	if s.sr == nil {
+		return errors.New("store is required")
+	}
+	return s.loadAccountCache()
+}
+
+// loadAccountCache indexes the users of all stored generator configurations
+func (s *Backend) loadAccountCache() error {
+	accounts, err := s.sr.ListAccounts()
+	if err != nil {
+		return err
+	}
+	for _, a := range accounts {
+		d, err := s.sr.GetConfig(a)
+		if err != nil {
+			return err
+		}
+		if d == nil {
+			continue
+		}
+		// index what the store indexed, even if it no longer decodes
+		c := rawConfig(d)
+		if c == nil {
+			// don't take down the other accounts
+			log.Printf("[cm] skipping unreadable configuration for %s", a)
+			continue
+		}
+		if c.Kind == Generator {
+			s.accounts.Update(c.Account, c.ListUsers())
+		}
+	}
+	return nil
 }
 
 func (s *Backend) Stop() error {
@@ -37,60 +187,248 @@ func (s *Backend) UpdateAccountConfig(token []byte) error {
 	if gc.Type != DashboardConfigurationType {
 		return fmt.Errorf("not supported - %s", gc.Type)
 	}
+	unlock := s.locks.Lock(strings.ToUpper(gc.Issuer))
+	defer unlock()
+	if err := s.verifyAccount(token); err != nil {
+		return err
+	}
+	if err := s.checkRoleKeys(token); err != nil {
+		return err
+	}
 	c, err := s.sr.StoreAccountConfig(token)
 	if err != nil {
 		return err
 	}
+	s.updateAccountCache(c)
+	return nil
+}
+
+func (s *Backend) updateAccountCache(c *Config) {
 	if c.Kind == Generator {
 		s.accounts.Update(c.Account, c.ListUsers())
 	} else {
 		s.accounts.RemoveAll(c.Account)
 	}
+}
+
+// GetAccountConfig returns the view of the configuration for the
+// account that signed the request. Configurations outside their time
+// bounds are returned along with ErrConfigExpired or ErrConfigNotYetValid.
+func (s *Backend) GetAccountConfig(token []byte) (*ConfigView, error) {
+	account, err := s.requestAccount(token)
+	if err != nil {
+		return nil, err
+	}
+	d, err := s.sr.GetConfig(account)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	c, err := decodeConfig(d)
+	if err != nil {
+		return nil, err
+	}
+	v, err := c.View()
+	if err != nil {
+		return nil, err
+	}
+	// the view is returned with the reasons no users are issued for it
+	return v, errors.Join(c.CheckTimeBounds(), s.checkTrust(c))
+}
+
+// GetAccountConfigJwt returns the configuration JWT as submitted, or
+// the JWT of the revision if not zero. As the JWT includes signing key
+// seeds, the request must be a single use request token of type
+// DashboardConfigurationJwtType.
+func (s *Backend) GetAccountConfigJwt(token []byte, revision int) ([]byte, error) {
+	account, err := s.authorizeRequest(token, DashboardConfigurationJwtType)
+	if err != nil {
+		return nil, err
+	}
+	if revision != 0 {
+		return s.sr.GetConfigRevision(account, revision)
+	}
+	return s.sr.GetConfig(account)
+}
+
+func (s *Backend) ListAccountConfigRevisions(token []byte) ([]ConfigRevision, error) {
+	account, err := s.authorizeRequest(token, DashboardConfigurationRequestType)
+	if err != nil {
+		return nil, err
+	}
+	return s.sr.ListConfigRevisions(account)
+}
+
+// GetAccountConfigRevision returns the view of the configuration revision
+func (s *Backend) GetAccountConfigRevision(token []byte, revision int) (*ConfigView, error) {
+	account, err := s.authorizeRequest(token, DashboardConfigurationRequestType)
+	if err != nil {
+		return nil, err
+	}
+	d, err := s.sr.GetConfigRevision(account, revision)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	return configView(d)
+}
+
+func (s *Backend) RollbackAccountConfig(token []byte, revision int) error {
+	account, err := s.authorizeRequest(token, DashboardConfigurationRequestType)
+	if err != nil {
+		return err
+	}
+	unlock := s.locks.Lock(strings.ToUpper(account))
+	defer unlock()
+	// the revision must pass the checks of an update
+	d, err := s.sr.GetConfigRevision(account, revision)
+	if err != nil {
+		return err
+	}
+	if d != nil {
+		if err := s.verifyAccount(d); err != nil {
+			return err
+		}
+		if err := s.checkRoleKeys(d); err != nil {
+			return err
+		}
+	}
+	c, err := s.sr.RollbackConfig(account, revision)
+	if err != nil {
+		return err
+	}
+	s.updateAccountCache(c)
 	return nil
 }
 
-func (s *Backend) GetAccountConfig(token []byte) ([]byte, error) {
+// requestAccount returns the account that signed a configuration request
+func (s *Backend) requestAccount(token []byte) (string, error) {
 	gc, err := jwt.DecodeGeneric(string(token))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	if gc.Type != DashboardConfigurationType {
-		return nil, fmt.Errorf("bad request")
+		return "", fmt.Errorf("bad request")
 	}
-	return s.sr.GetConfig(gc.Issuer)
+	return gc.Issuer, nil
+}
+
+// authorizeRequest returns the account that signed the request token.
+// The token must be of the type, carry no data and expire within
+// MaxRequestTTL, and is only accepted once.
+func (s *Backend) authorizeRequest(token []byte, typ string) (string, error) {
+	gc, err := jwt.DecodeGeneric(string(token))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if string(gc.Type) != typ {
+		return "", fmt.Errorf("%w: type must be %s", ErrInvalidRequest, typ)
+	}
+	if len(gc.Data) > 0 {
+		return "", fmt.Errorf("%w: request cannot carry data", ErrInvalidRequest)
+	}
+	now := time.Now()
+	exp := time.Unix(gc.Expires, 0)
+	if gc.Expires == 0 || exp.Sub(now) > MaxRequestTTL {
+		return "", fmt.Errorf("%w: request must expire within %v", ErrInvalidRequest, MaxRequestTTL)
+	}
+	if now.After(exp) {
+		return "", fmt.Errorf("%w: request expired", ErrInvalidRequest)
+	}
+	if !s.requests.use(gc.Issuer+"."+gc.ID, exp) {
+		return "", fmt.Errorf("%w: request was already used", ErrInvalidRequest)
+	}
+	return gc.Issuer, nil
 }
 
 func (s *Backend) GetUserAccounts(email string) ([]string, error) {
 	email = strings.ToUpper(email)
-	accounts, err := s.sr.GetUserAccounts(email)
+	// patterns are not users
+	if IsUserPattern(email) {
+		return nil, nil
+	}
+	found, err := s.sr.GetUserAccounts(email)
 	if err != nil {
 		return nil, err
 	}
-	accounts = append(accounts, s.accounts.Accounts(email)...)
+	// the store indexes generator accounts too, the cache
+	// only adds accounts it knows about that are not persisted
+	var accounts StringList
+	accounts.Add(found...)
+	accounts.Add(s.accounts.Accounts(email)...)
 	return accounts, nil
 }
 func (s *Backend) GetUserJwt(account string, email string) ([]byte, error) {
+	token, _, err := s.GetUserCreds(account, email, false)
+	return token, err
+}
+
+// GetUserCreds returns the user JWT, and for generated users issued
+// full credentials, the decorated credentials file. Static users
+// never have credentials as their seeds are not known.
+func (s *Backend) GetUserCreds(account string, email string, creds bool) ([]byte, []byte, error) {
 	cd, err := s.sr.GetConfig(account)
+	if err != nil || cd == nil {
+		return nil, nil, err
+	}
+
+	c, err := loadConfig(cd)
 	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.checkTrust(c); err != nil {
+		return nil, nil, err
+	}
+	c.SetCurveKey(s.curve)
+	c.SetSigner(s.signer)
+	switch c.Kind {
+	case Static:
+		td, err := s.sr.GetUserJwt(email, account)
+		if err != nil {
+			return nil, nil, err
+		}
+		if td == nil {
+			return nil, nil, nil
+		}
+		return td, nil, nil
+	case Generator:
+		return c.GetUserCreds(email, creds)
+	default:
+		return nil, nil, fmt.Errorf("unknown configuration type - %q", c.Kind)
+	}
+}
+
+// GetUserJwtForKey returns a user JWT bound to the user public key.
+// Static user JWTs are only returned if they were issued for the key.
+func (s *Backend) GetUserJwtForKey(account string, email string, upk string) ([]byte, error) {
+	cd, err := s.sr.GetConfig(account)
+	if err != nil || cd == nil {
 		return nil, err
 	}
 
-	c, err := ParseConfig(cd)
+	c, err := loadConfig(cd)
 	if err != nil {
 		return nil, err
 	}
+	if err := s.checkTrust(c); err != nil {
+		return nil, err
+	}
+	c.SetCurveKey(s.curve)
+	c.SetSigner(s.signer)
 	switch c.Kind {
 	case Static:
 		td, err := s.sr.GetUserJwt(email, account)
+		if err != nil || td == nil {
+			return nil, err
+		}
+		uc, err := jwt.DecodeUserClaims(string(td))
 		if err != nil {
 			return nil, err
 		}
-		if td == nil {
+		if uc.Subject != upk {
 			return nil, nil
 		}
 		return td, nil
 	case Generator:
-		return c.GetUserJwt(email)
+		return c.GetUserJwtForKey(email, upk)
 	default:
 		return nil, fmt.Errorf("unknown configuration type - %q", c.Kind)
 	}
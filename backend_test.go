@@ -1,8 +1,15 @@
 package cm
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/nats-io/jwt"
+	jwtv2 "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
 	"github.com/stretchr/testify/require"
 )
 
@@ -10,7 +17,7 @@ func TestBackendSimple(t *testing.T) {
 	ts := NewCredentialsTestSetup(t)
 	defer ts.Cleanup(t)
 
-	be := NewBackend(ts.dir)
+	be := NewBackend(ts.FileStore(t))
 	require.NoError(t, be.Start())
 
 	// add a generator configuration
@@ -50,3 +57,292 @@ func TestBackendSimple(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, a, string(d))
 }
+
+// fakeStore only implements the methods the tests use
+type fakeStore struct {
+	Store
+	configs map[string][]byte
+}
+
+func (fs *fakeStore) StoreAccountConfig(token []byte) (*Config, error) {
+	c, err := ParseConfig(token)
+	if err != nil {
+		return nil, err
+	}
+	fs.configs[c.Account] = token
+	return c, nil
+}
+
+func (fs *fakeStore) StoreUserJwt(_ []byte) error {
+	return errors.New("not supported")
+}
+
+func (fs *fakeStore) GetConfig(account string) ([]byte, error) {
+	return fs.configs[account], nil
+}
+
+func (fs *fakeStore) GetUserJwt(_ string, _ string) ([]byte, error) {
+	return nil, nil
+}
+
+func (fs *fakeStore) GetUserAccounts(_ string) ([]string, error) {
+	return nil, nil
+}
+
+func (fs *fakeStore) ListAccounts() ([]string, error) {
+	var accounts []string
+	for a := range fs.configs {
+		accounts = append(accounts, a)
+	}
+	return accounts, nil
+}
+
+func TestBackendCustomStore(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	fs := &fakeStore{configs: make(map[string][]byte)}
+	be := NewBackend(fs)
+	require.NoError(t, be.Start())
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+	require.Len(t, fs.configs, 1)
+
+	// generator accounts are served from the cache and the fake store
+	accounts, err := be.GetUserAccounts("a@x.y.c")
+	require.NoError(t, err)
+	require.Equal(t, []string{ts.PublicKey(t, akp)}, accounts)
+
+	d, err := be.GetUserJwt(ts.PublicKey(t, akp), "a@x.y.c")
+	require.NoError(t, err)
+	uc, err := jwtv2.DecodeUserClaims(string(d))
+	require.NoError(t, err)
+	require.Equal(t, "a@x.y.c", uc.Name)
+
+	require.Error(t, be.AddUserJwt([]byte(ts.CreateUser(t, "a@x.y.c", akp))))
+}
+
+func TestBackendRestartLoadsGenerators(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	// the fake store doesn't index users, so accounts come from the cache
+	fs := &fakeStore{configs: make(map[string][]byte)}
+	be := NewBackend(fs)
+	require.NoError(t, be.Start())
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+
+	a2kp := ts.CreateAccountPair(t)
+	src := ts.CreateResolverConfig(t, Static)
+	src.Users = append(src.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, src, a2kp))))
+	require.NoError(t, be.Stop())
+	// an unreadable configuration doesn't keep the others from loading
+	fs.configs[ts.PublicKey(t, ts.CreateAccountPair(t))] = []byte("not a jwt")
+
+	// a new backend on the same data has the generator users
+	be = NewBackend(fs)
+	require.NoError(t, be.Start())
+	accounts, err := be.GetUserAccounts("A@x.y.c")
+	require.NoError(t, err)
+	require.Equal(t, []string{ts.PublicKey(t, akp)}, accounts)
+}
+
+func TestBackendReportsConfigTimeBounds(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	fs := &fakeStore{configs: make(map[string][]byte)}
+	be := NewBackend(fs)
+	require.NoError(t, be.Start())
+
+	request := func(akp nkeys.KeyPair) []byte {
+		req := jwt.NewGenericClaims(ts.PublicKey(t, akp))
+		req.Type = DashboardConfigurationType
+		return []byte(ts.Encode(t, req, akp))
+	}
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+
+	// a configuration that is not yet valid is not reported as expired
+	akp := ts.CreateAccountPair(t)
+	gc := ts.ResolverConfigClaims(t, rc, akp)
+	gc.NotBefore = time.Now().Add(time.Hour).Unix()
+	fs.configs[ts.PublicKey(t, akp)] = []byte(ts.Encode(t, gc, akp))
+	v, err := be.GetAccountConfig(request(akp))
+	require.ErrorIs(t, err, ErrConfigNotYetValid)
+	require.NotErrorIs(t, err, ErrConfigExpired)
+	require.NotNil(t, v)
+
+	gc = ts.ResolverConfigClaims(t, rc, akp)
+	gc.Expires = time.Now().Add(-time.Hour).Unix()
+	fs.configs[ts.PublicKey(t, akp)] = []byte(ts.Encode(t, gc, akp))
+	v, err = be.GetAccountConfig(request(akp))
+	require.ErrorIs(t, err, ErrConfigExpired)
+	require.NotErrorIs(t, err, ErrConfigNotYetValid)
+	require.NotNil(t, v)
+}
+
+func TestBackendIndexesAllKinds(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	be := NewBackend(ts.FileStore(t))
+	require.NoError(t, be.Start())
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+
+	a2kp := ts.CreateAccountPair(t)
+	src := ts.CreateResolverConfig(t, Static)
+	src.Users = append(src.Users, ts.MakeUserConfig("A@x.y.c", Owner))
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, src, a2kp))))
+
+	// the index is persisted, so a new store finds both accounts
+	accounts, err := ts.FileStore(t).GetUserAccounts("a@X.y.c")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{ts.PublicKey(t, akp), ts.PublicKey(t, a2kp)}, accounts)
+
+	// removing the user from the generator updates the index
+	rc.Users = nil
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+	accounts, err = be.GetUserAccounts("a@x.y.c")
+	require.NoError(t, err)
+	require.Equal(t, []string{ts.PublicKey(t, a2kp)}, accounts)
+}
+
+func TestBackendConcurrentAccess(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	be := NewBackend(ts.FileStore(t))
+	require.NoError(t, be.Start())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 4; i++ {
+		akp := ts.CreateAccountPair(t)
+		// alternate kinds, each configuration must be different to be accepted
+		var configs []string
+		for j := 0; j < 10; j++ {
+			rc := ts.CreateResolverConfig(t, ResolverType(j%2))
+			rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+			rc.Users = append(rc.Users, ts.MakeUserConfig(fmt.Sprintf("%d@x.y.z", j), Owner))
+			configs = append(configs, ts.EncodeResolverConfig(t, rc, akp))
+		}
+		user := ts.CreateUser(t, "a@x.y.z", akp)
+		apk := ts.PublicKey(t, akp)
+
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := be.UpdateAccountConfig([]byte(configs[j])); err != nil {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := be.AddUserJwt([]byte(user)); err != nil {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := be.GetUserAccounts("a@x.y.z"); err != nil {
+					errs <- err
+				}
+				if _, err := be.GetUserJwt(apk, "a@x.y.z"); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// every account lists the user once the dust settles
+	accounts, err := be.GetUserAccounts("a@x.y.z")
+	require.NoError(t, err)
+	require.Len(t, accounts, 4)
+}
+
+func TestAccountCacheConcurrentAccess(t *testing.T) {
+	ac := NewAccountCache()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		account := fmt.Sprintf("A%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ac.Update(account, []string{"a@x.y.z", "b@x.y.z"})
+				ac.RemoveAll(account)
+			}
+			ac.Update(account, []string{"a@x.y.z"})
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ac.Accounts("a@x.y.z")
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, ac.Accounts("a@x.y.z"), 4)
+	require.Empty(t, ac.Accounts("b@x.y.z"))
+}
+
+func TestStoresMatchUserPatterns(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	kv, err := NewKVStore(ts.NatsClient(t, "kv"))
+	require.NoError(t, err)
+	stores := map[string]Store{"file": ts.FileStore(t), "memory": NewMemoryStore(), "kv": kv}
+	for n, store := range stores {
+		akp := ts.CreateAccountPair(t)
+		apk := ts.PublicKey(t, akp)
+		rc := ts.CreateResolverConfig(t, Generator)
+		rc.Users = append(rc.Users, ts.MakeUserConfig("*@"+n+".x.y.z", Monitor))
+		_, err := store.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+		require.NoError(t, err, n)
+
+		accounts, err := store.GetUserAccounts("someone@" + n + ".X.y.z")
+		require.NoError(t, err, n)
+		require.Equal(t, []string{apk}, accounts, n)
+		accounts, err = store.GetUserAccounts("someone@other.x.y.z")
+		require.NoError(t, err, n)
+		require.Empty(t, accounts, n)
+		accounts, err = store.GetUserAccounts("*@" + n + ".x.y.z")
+		require.NoError(t, err, n)
+		require.Empty(t, accounts, n)
+
+		// removing the pattern removes the account
+		rc.Users = Users{ts.MakeUserConfig("someone@"+n+".x.y.z", Owner)}
+		_, err = store.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+		require.NoError(t, err, n)
+		accounts, err = store.GetUserAccounts("other@" + n + ".x.y.z")
+		require.NoError(t, err, n)
+		require.Empty(t, accounts, n)
+		accounts, err = store.GetUserAccounts("someone@" + n + ".x.y.z")
+		require.NoError(t, err, n)
+		require.Equal(t, []string{apk}, accounts, n)
+	}
+}
@@ -1,23 +1,58 @@
 package cm
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 
+	jwtv2 "github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-server/v2/logger"
 	natsserver "github.com/nats-io/nats-server/v2/server"
 	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 type CredentialsManager struct {
 	NatsHostPort    string
 	CredentialsFile string
 	DataDir         string
-	nc              *nats.Conn
-	backend         *Backend
-	logger          natsserver.Logger
+	// JetStream stores all data in JetStream key-value buckets instead of DataDir
+	JetStream bool
+	// Store overrides the default file store rooted at DataDir
+	Store Store
+	// IdentityIssuers are the public keys of the login services whose
+	// identity assertions are required to request user JWTs
+	IdentityIssuers []string
+	// OIDCIssuer, OIDCAudience and OIDCJWKS (a URL or file path) configure
+	// the verification of OIDC ID tokens, which are then required to
+	// request user JWTs unless an identity assertion is provided
+	OIDCIssuer   string
+	OIDCAudience string
+	OIDCJWKS     string
+	// AccountJwts is where account JWTs are looked up to verify generator
+	// signing keys: a directory, a URL, or `nats[:<subject>]`
+	AccountJwts string
+	// TrustedOperators restricts configurations to accounts issued by the
+	// operators, as operator keys, JWTs or JWT files. Requires AccountJwts.
+	TrustedOperators []string
+	// CurveKeyFile holds the curve (x25519) seed that generator signing
+	// keys can be sealed for
+	CurveKeyFile string
+	// ExternalSigner signs with external generator signing keys:
+	// `unix:<path>` or `nats[:<subject>]`
+	ExternalSigner string
+	nc             *nats.Conn
+	backend        *Backend
+	nonces         *Nonces
+	identity       []IdentityVerifier
+	oidc           IdentityVerifier
+	curve          nkeys.KeyPair
+	logger         natsserver.Logger
 }
 
 func (cm *CredentialsManager) init() error {
@@ -25,10 +60,75 @@ func (cm *CredentialsManager) init() error {
 	if cm.NatsHostPort == "" {
 		log.Fatal("nats hostport is required")
 	}
-	if cm.DataDir == "" {
+	if cm.Store == nil && !cm.JetStream && cm.DataDir == "" {
 		log.Fatal("data dir is required")
 	}
-	cm.backend = NewBackend(cm.DataDir)
+	cm.nonces = NewNonces(DefaultNonceTTL)
+	if len(cm.IdentityIssuers) > 0 {
+		v, err := NewNKeyIdentityVerifier(cm.IdentityIssuers...)
+		if err != nil {
+			return err
+		}
+		cm.identity = append(cm.identity, v)
+	}
+	if cm.OIDCIssuer != "" || cm.OIDCAudience != "" || cm.OIDCJWKS != "" {
+		v, err := NewOIDCVerifier(cm.OIDCIssuer, cm.OIDCAudience, cm.OIDCJWKS)
+		if err != nil {
+			return err
+		}
+		cm.oidc = v
+	}
+	if cm.CurveKeyFile != "" {
+		d, err := os.ReadFile(cm.CurveKeyFile)
+		if err != nil {
+			return err
+		}
+		cm.curve, err = nkeys.FromCurveSeed(bytes.TrimSpace(d))
+		if err != nil {
+			return fmt.Errorf("error loading curve key: %v", err)
+		}
+	}
+	return nil
+}
+
+func (cm *CredentialsManager) initBackend() error {
+	if cm.Store == nil {
+		var err error
+		if cm.JetStream {
+			cm.Store, err = NewKVStore(cm.nc)
+		} else {
+			cm.Store, err = NewStaticResolver(cm.DataDir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cm.backend = NewBackend(cm.Store)
+	if cm.AccountJwts != "" {
+		src, err := NewAccountJwtSource(cm.AccountJwts, cm.nc)
+		if err != nil {
+			return err
+		}
+		cm.backend.SetAccountJwtSource(src)
+	}
+	if len(cm.TrustedOperators) > 0 {
+		if cm.AccountJwts == "" {
+			return errors.New("trusted operators require account jwts")
+		}
+		operators, err := NewTrustedOperators(cm.TrustedOperators...)
+		if err != nil {
+			return err
+		}
+		cm.backend.SetTrustedOperators(operators)
+	}
+	cm.backend.SetCurveKey(cm.curve)
+	if cm.ExternalSigner != "" {
+		signer, err := NewSigner(cm.ExternalSigner, cm.nc)
+		if err != nil {
+			return err
+		}
+		cm.backend.SetSigner(signer)
+	}
 	return cm.backend.Start()
 }
 
@@ -37,6 +137,12 @@ const SubjUserAccounts = "cm.get.user.accounts"
 const SubjAddUserJwt = "cm.add.user.jwt"
 const SubjUpdateAccountConfig = "cm.update.account.config"
 const SubjGetAccountConfig = "cm.get.account.config"
+const SubjGetAccountConfigJwt = "cm.get.account.config.jwt"
+const SubjListAccountConfigRevisions = "cm.list.account.config.revisions"
+const SubjGetAccountConfigRevision = "cm.get.account.config.revision"
+const SubjRollbackAccountConfig = "cm.rollback.account.config"
+const SubjGetNonce = "cm.get.nonce"
+const SubjGetCurveKey = "cm.get.curve.key"
 
 func (cm *CredentialsManager) Run() error {
 	var err error
@@ -54,6 +160,10 @@ func (cm *CredentialsManager) Run() error {
 	if cm.nc, err = nats.Connect(cm.NatsHostPort, options...); err != nil {
 		return err
 	}
+	if err = cm.initBackend(); err != nil {
+		cm.nc.Close()
+		return err
+	}
 	// FIXME: check errors
 	// FIXME: add handlers
 	cm.nc.Subscribe(SubjGetUserJwt, cm.GetUserJwt)
@@ -61,6 +171,12 @@ func (cm *CredentialsManager) Run() error {
 	cm.nc.Subscribe(SubjAddUserJwt, cm.AddUserJwt)
 	cm.nc.Subscribe(SubjUpdateAccountConfig, cm.UpdateAccountConfig)
 	cm.nc.Subscribe(SubjGetAccountConfig, cm.GetAccountConfig)
+	cm.nc.Subscribe(SubjGetAccountConfigJwt, cm.GetAccountConfigJwt)
+	cm.nc.Subscribe(SubjListAccountConfigRevisions, cm.ListAccountConfigRevisions)
+	cm.nc.Subscribe(SubjGetAccountConfigRevision, cm.GetAccountConfigRevision)
+	cm.nc.Subscribe(SubjRollbackAccountConfig, cm.RollbackAccountConfig)
+	cm.nc.Subscribe(SubjGetNonce, cm.GetNonce)
+	cm.nc.Subscribe(SubjGetCurveKey, cm.GetCurveKey)
 	cm.nc.Flush()
 	return nil
 }
@@ -71,17 +187,47 @@ func (cm *CredentialsManager) Stop() {
 
 type RequestResponse struct {
 	Error string `json:"error"`
+	Code  int    `json:"code,omitempty"`
+}
+
+// UserKey binds a generated user JWT to a public key held by the
+// client. Sig is the base64 URL encoded signature of a nonce from
+// SubjGetNonce, proving possession of the key.
+type UserKey struct {
+	PublicKey string `json:"public_key,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Sig       string `json:"sig,omitempty"`
 }
 
 type UserRequest struct {
 	Email   string `json:"email"`
 	Account string `json:"account"`
+	// Creds requests full credentials instead of a bearer JWT
+	Creds bool `json:"creds,omitempty"`
+	// Identity asserts the email of the caller
+	Identity string `json:"identity,omitempty"`
+	// IDToken is an OIDC ID token, the email is taken from the token
+	IDToken string `json:"id_token,omitempty"`
+	UserKey
 }
 
 type UserResponse struct {
 	UserRequest
 	RequestResponse
 	Jwt string `json:"jwt"`
+	// Expires is the unix time when the JWT expires, if it does
+	Expires int64 `json:"expires,omitempty"`
+	// Credentials is the decorated credentials file when issuing credentials
+	Credentials string `json:"credentials,omitempty"`
+}
+
+// setJwt sets the JWT, its expiration and credentials on the response
+func (r *UserResponse) setJwt(token []byte, creds []byte) {
+	r.Jwt = string(token)
+	r.Credentials = string(creds)
+	if uc, err := jwtv2.DecodeUserClaims(r.Jwt); err == nil {
+		r.Expires = uc.Expires
+	}
 }
 
 func (cm *CredentialsManager) GetUserJwt(m *nats.Msg) {
@@ -89,20 +235,33 @@ func (cm *CredentialsManager) GetUserJwt(m *nats.Msg) {
 	if err := cm.ParseRequest(m, &req); err != nil {
 		return
 	}
+	email, ok := cm.identify(m, req.Email, req.Identity, req.IDToken)
+	if !ok || !cm.checkUserKey(m, req.UserKey, req.Creds) {
+		return
+	}
+	// don't echo the identity tokens
+	req.Email, req.Identity, req.IDToken = email, "", ""
 	var resp UserResponse
 	resp.UserRequest = req
-	d, err := cm.backend.GetUserJwt(req.Account, req.Email)
+	d, creds, err := cm.userCreds(req.Account, req.Email, req.UserKey, req.Creds)
 	if err != nil {
 		em := fmt.Sprintf("error retrieving user %q for account %s", req.Account, req.Email)
-		cm.RespondError(m, http.StatusInternalServerError, em, err)
+		cm.RespondError(m, configErrorStatus(err), em, err)
 		return
 	}
-	resp.Jwt = string(d)
+	resp.setJwt(d, creds)
 	cm.Respond(m, resp)
 }
 
 type UserAccountsRequest struct {
 	Email string `json:"email"`
+	// Creds requests full credentials instead of a bearer JWT
+	Creds bool `json:"creds,omitempty"`
+	// Identity asserts the email of the caller
+	Identity string `json:"identity,omitempty"`
+	// IDToken is an OIDC ID token, the email is taken from the token
+	IDToken string `json:"id_token,omitempty"`
+	UserKey
 }
 
 type UserAccountsResponse struct {
@@ -118,6 +277,12 @@ func (cm *CredentialsManager) GetUserAccounts(m *nats.Msg) {
 		return
 	}
 
+	email, ok := cm.identify(m, req.Email, req.Identity, req.IDToken)
+	if !ok || !cm.checkUserKey(m, req.UserKey, req.Creds) {
+		return
+	}
+	// don't echo the identity tokens
+	req.Email, req.Identity, req.IDToken = email, "", ""
 	var resp UserAccountsResponse
 	resp.UserAccountsRequest = req
 	accounts, err := cm.backend.GetUserAccounts(req.Email)
@@ -133,15 +298,124 @@ func (cm *CredentialsManager) GetUserAccounts(m *nats.Msg) {
 		return
 	case 1:
 		resp.Account = accounts[0]
-		d, err := cm.backend.GetUserJwt(accounts[0], req.Email)
+		d, creds, err := cm.userCreds(accounts[0], req.Email, req.UserKey, req.Creds)
 		if err != nil {
 			em := fmt.Sprintf("error retrieving user %q for account %s", req.Email, accounts[0])
-			cm.RespondError(m, http.StatusInternalServerError, em, err)
+			cm.RespondError(m, configErrorStatus(err), em, err)
 			return
 		} else {
-			resp.Jwt = string(d)
+			resp.setJwt(d, creds)
+		}
+	}
+	cm.Respond(m, resp)
+}
+
+// identify returns the email of the caller. If an ID token is provided,
+// or identity verification is configured, the email is the one asserted,
+// otherwise it is the one requested. On failure it responds with an
+// error and returns false.
+func (cm *CredentialsManager) identify(m *nats.Msg, email string, identity string, idToken string) (string, bool) {
+	var verifiers []IdentityVerifier
+	var token string
+	switch {
+	case idToken != "":
+		if cm.oidc == nil {
+			cm.RespondError(m, http.StatusBadRequest, "id tokens are not accepted", nil)
+			return "", false
+		}
+		verifiers = []IdentityVerifier{cm.oidc}
+		token = idToken
+	case len(cm.identity) > 0 || cm.oidc != nil:
+		verifiers = cm.identity
+		token = identity
+	default:
+		return email, true
+	}
+	if token == "" || len(verifiers) == 0 {
+		cm.RespondError(m, http.StatusUnauthorized, "error verifying identity", ErrIdentityRequired)
+		return "", false
+	}
+	var err error
+	for _, v := range verifiers {
+		var asserted string
+		if asserted, err = v.VerifyIdentity(token); err != nil {
+			continue
+		}
+		if email != "" && asserted != strings.ToLower(email) {
+			cm.RespondError(m, http.StatusForbidden, fmt.Sprintf("identity %q cannot request %q", asserted, email), nil)
+			return "", false
 		}
+		return asserted, true
+	}
+	cm.RespondError(m, http.StatusUnauthorized, "error verifying identity", err)
+	return "", false
+}
+
+// checkUserKey verifies the proof of possession for a client key,
+// responding with an error and returning false if it is invalid
+func (cm *CredentialsManager) checkUserKey(m *nats.Msg, key UserKey, creds bool) bool {
+	if key.PublicKey == "" {
+		return true
+	}
+	if creds {
+		cm.RespondError(m, http.StatusBadRequest, "credentials cannot be issued for client keys", nil)
+		return false
+	}
+	if err := cm.nonces.Verify(key.PublicKey, key.Nonce, key.Sig); err != nil {
+		cm.RespondError(m, http.StatusUnauthorized, fmt.Sprintf("error verifying user key %s", key.PublicKey), err)
+		return false
+	}
+	return true
+}
+
+// userCreds returns the user JWT, bound to the client key if one was provided
+func (cm *CredentialsManager) userCreds(account string, email string, key UserKey, creds bool) ([]byte, []byte, error) {
+	if key.PublicKey != "" {
+		d, err := cm.backend.GetUserJwtForKey(account, email, key.PublicKey)
+		return d, nil, err
+	}
+	return cm.backend.GetUserCreds(account, email, creds)
+}
+
+type NonceResponse struct {
+	RequestResponse
+	Nonce string `json:"nonce"`
+}
+
+func (cm *CredentialsManager) GetNonce(m *nats.Msg) {
+	var resp NonceResponse
+	nonce, err := cm.nonces.Issue()
+	if errors.Is(err, ErrTooManyNonces) {
+		cm.RespondError(m, http.StatusTooManyRequests, "error generating nonce", err)
+		return
+	}
+	if err != nil {
+		cm.RespondError(m, http.StatusInternalServerError, "error generating nonce", err)
+		return
+	}
+	resp.Nonce = nonce
+	cm.Respond(m, resp)
+}
+
+type CurveKeyResponse struct {
+	RequestResponse
+	PublicKey string `json:"public_key"`
+}
+
+// GetCurveKey returns the public curve key that generator signing
+// keys can be sealed for
+func (cm *CredentialsManager) GetCurveKey(m *nats.Msg) {
+	if cm.curve == nil {
+		cm.RespondError(m, http.StatusNotFound, "no curve key", nil)
+		return
 	}
+	var resp CurveKeyResponse
+	pk, err := cm.curve.PublicKey()
+	if err != nil {
+		cm.RespondError(m, http.StatusInternalServerError, "error reading curve key", err)
+		return
+	}
+	resp.PublicKey = pk
 	cm.Respond(m, resp)
 }
 
@@ -180,6 +454,18 @@ func (cm *CredentialsManager) UpdateAccountConfig(m *nats.Msg) {
 		return
 	}
 	if err := cm.backend.UpdateAccountConfig([]byte(req.Jwt)); err != nil {
+		if errors.Is(err, ErrStaleConfig) || errors.Is(err, ErrReplayedConfig) {
+			cm.RespondError(m, http.StatusConflict, "rejected account config", err)
+			return
+		}
+		if errors.Is(err, ErrUnregisteredSigningKey) || errors.Is(err, ErrSealedSigningKey) || errors.Is(err, ErrNoSigner) {
+			cm.RespondError(m, http.StatusBadRequest, "rejected account config", err)
+			return
+		}
+		if errors.Is(err, ErrUntrustedAccount) {
+			cm.RespondError(m, http.StatusForbidden, "rejected account config", err)
+			return
+		}
 		cm.RespondError(m, http.StatusInternalServerError, "error updating account config", err)
 		return
 	}
@@ -192,7 +478,14 @@ type AccountRequest struct {
 
 type AccountRequestResponse struct {
 	RequestResponse
-	Jwt string `json:"jwt"`
+	// Config is the configuration without signing key seeds
+	Config *ConfigView `json:"config,omitempty"`
+	// Expired is set if the configuration is expired
+	Expired bool `json:"expired,omitempty"`
+	// NotYetValid is set if the configuration is before its nbf
+	NotYetValid bool `json:"not_yet_valid,omitempty"`
+	// Untrusted is set if the account is not issued by a trusted operator
+	Untrusted bool `json:"untrusted,omitempty"`
 }
 
 func (cm *CredentialsManager) GetAccountConfig(m *nats.Msg) {
@@ -200,16 +493,134 @@ func (cm *CredentialsManager) GetAccountConfig(m *nats.Msg) {
 	if err := cm.ParseRequest(m, &req); err != nil {
 		return
 	}
-	d, err := cm.backend.GetAccountConfig([]byte(req.Token))
-	if err != nil {
+	var resp AccountRequestResponse
+	v, err := cm.backend.GetAccountConfig([]byte(req.Token))
+	resp.Expired = errors.Is(err, ErrConfigExpired)
+	resp.NotYetValid = errors.Is(err, ErrConfigNotYetValid)
+	resp.Untrusted = errors.Is(err, ErrUntrustedAccount)
+	if err != nil && !resp.Expired && !resp.NotYetValid && !resp.Untrusted {
 		cm.RespondError(m, http.StatusInternalServerError, "error getting account config", err)
 		return
 	}
-	var resp AccountRequestResponse
+	resp.Config = v
+	cm.Respond(m, resp)
+}
+
+type AccountConfigJwtResponse struct {
+	RequestResponse
+	Jwt string `json:"jwt"`
+}
+
+// GetAccountConfigJwt returns the configuration JWT, including its
+// signing key seeds. The request token must be a single use request
+// token of type DashboardConfigurationJwtType.
+func (cm *CredentialsManager) GetAccountConfigJwt(m *nats.Msg) {
+	var req AccountRevisionRequest
+	if err := cm.ParseRequest(m, &req); err != nil {
+		return
+	}
+	d, err := cm.backend.GetAccountConfigJwt([]byte(req.Token), req.Revision)
+	if errors.Is(err, ErrInvalidRequest) {
+		cm.RespondError(m, http.StatusForbidden, "rejected account config jwt request", err)
+		return
+	}
+	if err != nil {
+		cm.RespondError(m, http.StatusInternalServerError, "error getting account config jwt", err)
+		return
+	}
+	if d == nil {
+		cm.RespondError(m, http.StatusNotFound, "account config not found", nil)
+		return
+	}
+	var resp AccountConfigJwtResponse
 	resp.Jwt = string(d)
 	cm.Respond(m, resp)
 }
 
+// configErrorStatus returns the status for errors serving user credentials
+func configErrorStatus(err error) int {
+	if errors.Is(err, ErrConfigExpired) || errors.Is(err, ErrConfigNotYetValid) || errors.Is(err, ErrUntrustedAccount) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+type AccountRevisionsResponse struct {
+	RequestResponse
+	Revisions []ConfigRevision `json:"revisions"`
+}
+
+func (cm *CredentialsManager) ListAccountConfigRevisions(m *nats.Msg) {
+	var req AccountRequest
+	if err := cm.ParseRequest(m, &req); err != nil {
+		return
+	}
+	revisions, err := cm.backend.ListAccountConfigRevisions([]byte(req.Token))
+	if errors.Is(err, ErrInvalidRequest) {
+		cm.RespondError(m, http.StatusUnauthorized, "rejected account config request", err)
+		return
+	}
+	if err != nil {
+		cm.RespondError(m, http.StatusInternalServerError, "error listing account config revisions", err)
+		return
+	}
+	var resp AccountRevisionsResponse
+	resp.Revisions = revisions
+	cm.Respond(m, resp)
+}
+
+type AccountRevisionRequest struct {
+	AccountRequest
+	Revision int `json:"revision"`
+}
+
+func (cm *CredentialsManager) GetAccountConfigRevision(m *nats.Msg) {
+	var req AccountRevisionRequest
+	if err := cm.ParseRequest(m, &req); err != nil {
+		return
+	}
+	v, err := cm.backend.GetAccountConfigRevision([]byte(req.Token), req.Revision)
+	if errors.Is(err, ErrInvalidRequest) {
+		cm.RespondError(m, http.StatusUnauthorized, "rejected account config request", err)
+		return
+	}
+	if err != nil {
+		cm.RespondError(m, http.StatusInternalServerError, "error getting account config revision", err)
+		return
+	}
+	if v == nil {
+		cm.RespondError(m, http.StatusNotFound, fmt.Sprintf("revision %d not found", req.Revision), nil)
+		return
+	}
+	var resp AccountRequestResponse
+	resp.Config = v
+	cm.Respond(m, resp)
+}
+
+func (cm *CredentialsManager) RollbackAccountConfig(m *nats.Msg) {
+	var req AccountRevisionRequest
+	if err := cm.ParseRequest(m, &req); err != nil {
+		return
+	}
+	if err := cm.backend.RollbackAccountConfig([]byte(req.Token), req.Revision); err != nil {
+		if errors.Is(err, ErrInvalidRequest) {
+			cm.RespondError(m, http.StatusUnauthorized, "rejected account config request", err)
+			return
+		}
+		if errors.Is(err, ErrUnregisteredSigningKey) || errors.Is(err, ErrSealedSigningKey) || errors.Is(err, ErrNoSigner) {
+			cm.RespondError(m, http.StatusBadRequest, "rejected account config", err)
+			return
+		}
+		if errors.Is(err, ErrUntrustedAccount) {
+			cm.RespondError(m, http.StatusForbidden, "rejected account config", err)
+			return
+		}
+		cm.RespondError(m, http.StatusInternalServerError, "error rolling back account config", err)
+		return
+	}
+	cm.Respond(m, RequestResponse{})
+}
+
 func (cm *CredentialsManager) Respond(ctx *nats.Msg, o interface{}) {
 	d, err := json.MarshalIndent(o, "", "\t")
 	if err != nil {
@@ -228,7 +639,7 @@ func (cm *CredentialsManager) RespondError(ctx *nats.Msg, status int, msg string
 		em = fmt.Sprintf("[cm] %s: %v", msg, err)
 	}
 	cm.logger.Errorf(em)
-	cm.Respond(ctx, RequestResponse{Error: http.StatusText(status)})
+	cm.Respond(ctx, RequestResponse{Error: http.StatusText(status), Code: status})
 }
 
 func (cm *CredentialsManager) ParseRequest(ctx *nats.Msg, o interface{}) error {
@@ -1,10 +1,13 @@
 package cm
 
 import (
+	"encoding/base64"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/nats-io/jwt"
+	jwtv2 "github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nkeys"
 
 	"github.com/stretchr/testify/require"
@@ -46,7 +49,54 @@ func TestBackend_UpdateAccount(t *testing.T) {
 	require.NoError(t, err)
 	var gacr AccountRequestResponse
 	ts.FromJSON(t, r.Data, &gacr)
-	require.Equal(t, uac.Jwt, gacr.Jwt)
+	require.Empty(t, gacr.Error)
+	require.NotContains(t, string(r.Data), rc.ResolverOptions.(GeneratorConfig).Roles[0].SigningKey)
+	require.Equal(t, ts.PublicKey(t, akp), gacr.Config.Account)
+	require.Equal(t, Generator, gacr.Config.Kind)
+	require.Len(t, gacr.Config.Users, 2)
+	require.Len(t, gacr.Config.Roles, 3)
+	for _, role := range gacr.Config.Roles {
+		require.True(t, nkeys.IsValidPublicAccountKey(role.SigningKey))
+	}
+
+	// the configuration JWT requires a request of its own type
+	r, err = nc.Request(SubjGetAccountConfigJwt, payload, time.Second)
+	require.NoError(t, err)
+	var jr AccountConfigJwtResponse
+	ts.FromJSON(t, r.Data, &jr)
+	require.Equal(t, http.StatusForbidden, jr.Code)
+	require.Empty(t, jr.Jwt)
+
+	// which must expire soon
+	gc.Type = DashboardConfigurationJwtType
+	r, err = nc.Request(SubjGetAccountConfigJwt, ts.ToJSON(t, AccountRequest{Token: ts.Encode(t, gc, akp)}), time.Second)
+	require.NoError(t, err)
+	jr = AccountConfigJwtResponse{}
+	ts.FromJSON(t, r.Data, &jr)
+	require.Equal(t, http.StatusForbidden, jr.Code)
+	require.Empty(t, jr.Jwt)
+
+	payload = ts.ToJSON(t, AccountRequest{Token: ts.RequestToken(t, akp, DashboardConfigurationJwtType)})
+	r, err = nc.Request(SubjGetAccountConfigJwt, payload, time.Second)
+	require.NoError(t, err)
+	jr = AccountConfigJwtResponse{}
+	ts.FromJSON(t, r.Data, &jr)
+	require.Empty(t, jr.Error)
+	require.Equal(t, uac.Jwt, jr.Jwt)
+
+	// and is only accepted once
+	r, err = nc.Request(SubjGetAccountConfigJwt, payload, time.Second)
+	require.NoError(t, err)
+	jr = AccountConfigJwtResponse{}
+	ts.FromJSON(t, r.Data, &jr)
+	require.Equal(t, http.StatusForbidden, jr.Code)
+	require.Empty(t, jr.Jwt)
+
+	// and can't be used to read the configuration
+	r, err = nc.Request(SubjGetAccountConfig, payload, time.Second)
+	require.NoError(t, err)
+	ts.FromJSON(t, r.Data, &gacr)
+	require.NotEmpty(t, gacr.Error)
 }
 
 func TestBackend_GetUserJwt(t *testing.T) {
@@ -64,7 +114,7 @@ func TestBackend_GetUserJwt(t *testing.T) {
 	require.Equal(t, "a@x.y.z", uresp.Email)
 
 	require.NotEmpty(t, uresp.Jwt)
-	uc, err := jwt.DecodeUserClaims(uresp.Jwt)
+	uc, err := jwtv2.DecodeUserClaims(uresp.Jwt)
 	require.NoError(t, err)
 	require.Equal(t, uc.IssuerAccount, ts.PublicKey(t, akp))
 	gc := c.OptionsAsGeneratorConfig()
@@ -73,6 +123,81 @@ func TestBackend_GetUserJwt(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, uc.Issuer, ts.PublicKey(t, okp))
 	require.Equal(t, uc.Name, "a@x.y.z")
+	require.NotZero(t, uc.Expires)
+	require.Equal(t, uc.Expires, uresp.Expires)
+}
+
+func TestBackend_GetUserCreds(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	_, akp := setupAccount(t, ts, Generator)
+
+	nc := ts.NatsClient(t, "client")
+	ureq := UserRequest{Email: "a@x.y.z", Account: ts.PublicKey(t, akp), Creds: true}
+	r, err := nc.Request(SubjGetUserJwt, ts.ToJSON(t, ureq), time.Second)
+	require.NoError(t, err)
+	var uresp UserResponse
+	ts.FromJSON(t, r.Data, &uresp)
+	require.Empty(t, uresp.Error)
+	require.NotEmpty(t, uresp.Credentials)
+
+	token, err := jwt.ParseDecoratedJWT([]byte(uresp.Credentials))
+	require.NoError(t, err)
+	require.Equal(t, uresp.Jwt, token)
+	uc, err := jwtv2.DecodeUserClaims(token)
+	require.NoError(t, err)
+	require.False(t, uc.BearerToken)
+
+	ukp, err := jwt.ParseDecoratedNKey([]byte(uresp.Credentials))
+	require.NoError(t, err)
+	require.Equal(t, uc.Subject, ts.PublicKey(t, ukp))
+}
+
+func TestBackend_GetUserJwtForKey(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	_, akp := setupAccount(t, ts, Generator)
+	ukp, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	upk := ts.PublicKey(t, ukp)
+
+	nc := ts.NatsClient(t, "client")
+	request := func(nonce string) UserResponse {
+		sig, err := ukp.Sign([]byte(nonce))
+		require.NoError(t, err)
+		ureq := UserRequest{Email: "a@x.y.z", Account: ts.PublicKey(t, akp)}
+		ureq.UserKey = UserKey{PublicKey: upk, Nonce: nonce, Sig: base64.RawURLEncoding.EncodeToString(sig)}
+		r, err := nc.Request(SubjGetUserJwt, ts.ToJSON(t, ureq), time.Second)
+		require.NoError(t, err)
+		var uresp UserResponse
+		ts.FromJSON(t, r.Data, &uresp)
+		return uresp
+	}
+
+	r, err := nc.Request(SubjGetNonce, nil, time.Second)
+	require.NoError(t, err)
+	var nr NonceResponse
+	ts.FromJSON(t, r.Data, &nr)
+	require.NotEmpty(t, nr.Nonce)
+
+	uresp := request(nr.Nonce)
+	require.Empty(t, uresp.Error)
+	require.Empty(t, uresp.Credentials)
+	uc, err := jwtv2.DecodeUserClaims(uresp.Jwt)
+	require.NoError(t, err)
+	require.Equal(t, upk, uc.Subject)
+	require.False(t, uc.BearerToken)
+
+	// nonces are single use
+	uresp = request(nr.Nonce)
+	require.Equal(t, http.StatusUnauthorized, uresp.Code)
+	require.Empty(t, uresp.Jwt)
+
+	// and must be issued by the credentials manager
+	uresp = request("made up")
+	require.Equal(t, http.StatusUnauthorized, uresp.Code)
 }
 
 func TestBackend_GetStaticUserJwt(t *testing.T) {
@@ -152,3 +277,360 @@ func setupAccount(t *testing.T, ts *CredentialsTestSetup, kind ResolverType) (*R
 
 	return &rc, akp
 }
+
+func TestAccountConfigRevisions(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	rc, akp := setupAccount(t, ts, Generator)
+	nc := ts.NatsClient(t, "client")
+
+	// remove a user with a second configuration
+	rc.Users = rc.Users[:1]
+	var uac UpdateAccountRequest
+	uac.Jwt = ts.EncodeResolverConfig(t, *rc, akp)
+	r, err := nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, uac), time.Second)
+	require.NoError(t, err)
+	var uar UpdateAccountResponse
+	ts.FromJSON(t, r.Data, &uar)
+	require.Empty(t, uar.Error)
+
+	request := func() AccountRequest {
+		return AccountRequest{Token: ts.RequestToken(t, akp, DashboardConfigurationRequestType)}
+	}
+	r, err = nc.Request(SubjListAccountConfigRevisions, ts.ToJSON(t, request()), time.Second)
+	require.NoError(t, err)
+	var lr AccountRevisionsResponse
+	ts.FromJSON(t, r.Data, &lr)
+	require.Empty(t, lr.Error)
+	require.Len(t, lr.Revisions, 2)
+	require.Equal(t, 1, lr.Revisions[0].Revision)
+	require.Equal(t, 2, lr.Revisions[1].Revision)
+	require.NotEmpty(t, lr.Revisions[1].ID)
+	require.NotZero(t, lr.Revisions[1].IssuedAt)
+
+	req := AccountRevisionRequest{AccountRequest: request(), Revision: 1}
+	r, err = nc.Request(SubjGetAccountConfigRevision, ts.ToJSON(t, req), time.Second)
+	require.NoError(t, err)
+	var gr AccountRequestResponse
+	ts.FromJSON(t, r.Data, &gr)
+	require.Empty(t, gr.Error)
+	require.Len(t, gr.Config.Users, 3)
+
+	// request tokens are single use
+	var rr RequestResponse
+	r, err = nc.Request(SubjRollbackAccountConfig, ts.ToJSON(t, req), time.Second)
+	require.NoError(t, err)
+	ts.FromJSON(t, r.Data, &rr)
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// the user removed by revision 2 is back after the rollback
+	req.AccountRequest = request()
+	r, err = nc.Request(SubjRollbackAccountConfig, ts.ToJSON(t, req), time.Second)
+	require.NoError(t, err)
+	ts.FromJSON(t, r.Data, &rr)
+	require.Empty(t, rr.Error)
+
+	ureq := UserRequest{Email: "c@x.y.z", Account: ts.PublicKey(t, akp)}
+	r, err = nc.Request(SubjGetUserJwt, ts.ToJSON(t, ureq), time.Second)
+	require.NoError(t, err)
+	var uresp UserResponse
+	ts.FromJSON(t, r.Data, &uresp)
+	require.NotEmpty(t, uresp.Jwt)
+
+	r, err = nc.Request(SubjListAccountConfigRevisions, ts.ToJSON(t, request()), time.Second)
+	require.NoError(t, err)
+	ts.FromJSON(t, r.Data, &lr)
+	require.Len(t, lr.Revisions, 3)
+	require.Equal(t, lr.Revisions[0].ID, lr.Revisions[2].ID)
+
+	gc := jwt.NewGenericClaims(ts.PublicKey(t, akp))
+	gc.Type = DashboardConfigurationType
+	r, err = nc.Request(SubjGetAccountConfig, ts.ToJSON(t, AccountRequest{Token: ts.Encode(t, gc, akp)}), time.Second)
+	require.NoError(t, err)
+	ts.FromJSON(t, r.Data, &gr)
+	require.Equal(t, lr.Revisions[0].ID, gr.Config.ID)
+
+	// unknown revisions are not found
+	req = AccountRevisionRequest{AccountRequest: request(), Revision: 10}
+	r, err = nc.Request(SubjGetAccountConfigRevision, ts.ToJSON(t, req), time.Second)
+	require.NoError(t, err)
+	ts.FromJSON(t, r.Data, &rr)
+	require.Equal(t, http.StatusText(http.StatusNotFound), rr.Error)
+	req.AccountRequest = request()
+	r, err = nc.Request(SubjRollbackAccountConfig, ts.ToJSON(t, req), time.Second)
+	require.NoError(t, err)
+	ts.FromJSON(t, r.Data, &rr)
+	require.NotEmpty(t, rr.Error)
+}
+
+func TestRevisionRequestsRequireRequestTokens(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	rc, akp := setupAccount(t, ts, Generator)
+	leaked := ts.EncodeResolverConfig(t, *rc, akp)
+	time.Sleep(time.Second)
+	nc := ts.NatsClient(t, "client")
+	rc.Users = rc.Users[:1]
+	r, err := nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, UpdateAccountRequest{Jwt: ts.EncodeResolverConfig(t, *rc, akp)}), time.Second)
+	require.NoError(t, err)
+	var rr RequestResponse
+	ts.FromJSON(t, r.Data, &rr)
+	require.Empty(t, rr.Error)
+
+	noExpiry := jwt.NewGenericClaims(ts.PublicKey(t, akp))
+	noExpiry.Type = DashboardConfigurationRequestType
+	longLived := jwt.NewGenericClaims(ts.PublicKey(t, akp))
+	longLived.Type = DashboardConfigurationRequestType
+	longLived.Expires = time.Now().Add(time.Hour).Unix()
+	withData := jwt.NewGenericClaims(ts.PublicKey(t, akp))
+	withData.Type = DashboardConfigurationRequestType
+	withData.Expires = time.Now().Add(time.Minute).Unix()
+	withData.Data = map[string]interface{}{"kind": Generator}
+
+	// a leaked configuration cannot roll back to a revision
+	for _, token := range []string{leaked, ts.Encode(t, noExpiry, akp), ts.Encode(t, longLived, akp), ts.Encode(t, withData, akp)} {
+		req := AccountRevisionRequest{AccountRequest: AccountRequest{Token: token}, Revision: 1}
+		for _, subj := range []string{SubjRollbackAccountConfig, SubjGetAccountConfigRevision, SubjListAccountConfigRevisions} {
+			r, err = nc.Request(subj, ts.ToJSON(t, req), time.Second)
+			require.NoError(t, err)
+			ts.FromJSON(t, r.Data, &rr)
+			require.Equal(t, http.StatusUnauthorized, rr.Code, subj)
+		}
+	}
+	ureq := UserRequest{Email: "b@x.y.z", Account: ts.PublicKey(t, akp)}
+	r, err = nc.Request(SubjGetUserJwt, ts.ToJSON(t, ureq), time.Second)
+	require.NoError(t, err)
+	var uresp UserResponse
+	ts.FromJSON(t, r.Data, &uresp)
+	require.Empty(t, uresp.Jwt)
+}
+
+func TestRejectReplayedAccountConfig(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	var cm CredentialsManager
+	cm.NatsHostPort = ts.ns.ClientURL()
+	cm.DataDir = ts.dir
+	require.NoError(t, cm.Run())
+	defer cm.Stop()
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Static)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	old := ts.EncodeResolverConfig(t, rc, akp)
+	// iat has a resolution of seconds
+	time.Sleep(time.Second)
+	rc.Users = nil
+	current := ts.EncodeResolverConfig(t, rc, akp)
+
+	nc := ts.NatsClient(t, "client")
+	update := func(token string) UpdateAccountResponse {
+		r, err := nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, UpdateAccountRequest{Jwt: token}), time.Second)
+		require.NoError(t, err)
+		var uar UpdateAccountResponse
+		ts.FromJSON(t, r.Data, &uar)
+		return uar
+	}
+	require.Empty(t, update(current).Error)
+
+	// older configurations cannot restore the user
+	uar := update(old)
+	require.Equal(t, http.StatusConflict, uar.Code)
+	require.Equal(t, http.StatusText(http.StatusConflict), uar.Error)
+
+	// nor can the current configuration be submitted again
+	uar = update(current)
+	require.Equal(t, http.StatusConflict, uar.Code)
+
+	_, err := cm.Store.StoreAccountConfig([]byte(old))
+	require.Equal(t, ErrStaleConfig, err)
+	_, err = cm.Store.StoreAccountConfig([]byte(current))
+	require.Equal(t, ErrReplayedConfig, err)
+}
+
+func TestExpiredAccountConfig(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	var cm CredentialsManager
+	cm.NatsHostPort = ts.ns.ClientURL()
+	cm.DataDir = ts.dir
+	require.NoError(t, cm.Run())
+	defer cm.Stop()
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	nc := ts.NatsClient(t, "client")
+
+	// expired configurations are not accepted
+	gc := ts.ResolverConfigClaims(t, rc, akp)
+	gc.Expires = time.Now().Add(-time.Minute).Unix()
+	r, err := nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, UpdateAccountRequest{Jwt: ts.Encode(t, gc, akp)}), time.Second)
+	require.NoError(t, err)
+	var uar UpdateAccountResponse
+	ts.FromJSON(t, r.Data, &uar)
+	require.NotEmpty(t, uar.Error)
+
+	// and stop generating users once they expire
+	gc = ts.ResolverConfigClaims(t, rc, akp)
+	gc.Expires = time.Now().Add(time.Second).Unix()
+	r, err = nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, UpdateAccountRequest{Jwt: ts.Encode(t, gc, akp)}), time.Second)
+	require.NoError(t, err)
+	ts.FromJSON(t, r.Data, &uar)
+	require.Empty(t, uar.Error)
+	time.Sleep(2 * time.Second)
+
+	ureq := UserRequest{Email: "a@x.y.z", Account: ts.PublicKey(t, akp)}
+	r, err = nc.Request(SubjGetUserJwt, ts.ToJSON(t, ureq), time.Second)
+	require.NoError(t, err)
+	var uresp UserResponse
+	ts.FromJSON(t, r.Data, &uresp)
+	require.Equal(t, http.StatusForbidden, uresp.Code)
+	require.Empty(t, uresp.Jwt)
+
+	req := jwt.NewGenericClaims(ts.PublicKey(t, akp))
+	req.Type = DashboardConfigurationType
+	r, err = nc.Request(SubjGetAccountConfig, ts.ToJSON(t, AccountRequest{Token: ts.Encode(t, req, akp)}), time.Second)
+	require.NoError(t, err)
+	var gacr AccountRequestResponse
+	ts.FromJSON(t, r.Data, &gacr)
+	require.Empty(t, gacr.Error)
+	require.True(t, gacr.Expired)
+	require.False(t, gacr.NotYetValid)
+	require.False(t, gacr.Untrusted)
+	require.NotNil(t, gacr.Config)
+}
+
+func TestIdentityAssertion(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	ikp := ts.CreateAccountPair(t)
+	var cm CredentialsManager
+	cm.NatsHostPort = ts.ns.ClientURL()
+	cm.Store = NewMemoryStore()
+	cm.IdentityIssuers = []string{ts.PublicKey(t, ikp)}
+	require.NoError(t, cm.Run())
+	defer cm.Stop()
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	rc.Users = append(rc.Users, ts.MakeUserConfig("b@x.y.z", Manager))
+
+	nc := ts.NatsClient(t, "driver")
+	var uac UpdateAccountRequest
+	uac.Jwt = ts.EncodeResolverConfig(t, rc, akp)
+	r, err := nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, uac), time.Second)
+	require.NoError(t, err)
+
+	assert := func(email string, kp nkeys.KeyPair, expires time.Duration) string {
+		gc := jwt.NewGenericClaims(email)
+		gc.Type = IdentityAssertionType
+		if expires != 0 {
+			gc.Expires = time.Now().Add(expires).Unix()
+		}
+		return ts.Encode(t, gc, kp)
+	}
+	request := func(identity string) UserResponse {
+		ureq := UserRequest{Email: "a@x.y.z", Account: ts.PublicKey(t, akp), Identity: identity}
+		r, err = nc.Request(SubjGetUserJwt, ts.ToJSON(t, ureq), time.Second)
+		require.NoError(t, err)
+		var uresp UserResponse
+		ts.FromJSON(t, r.Data, &uresp)
+		return uresp
+	}
+
+	uresp := request(assert("A@x.y.z", ikp, time.Minute))
+	require.Empty(t, uresp.Error)
+	require.NotEmpty(t, uresp.Jwt)
+
+	// missing, untrusted, expiring and expired assertions
+	require.Equal(t, http.StatusUnauthorized, request("").Code)
+	require.Equal(t, http.StatusUnauthorized, request(assert("a@x.y.z", ts.CreateAccountPair(t), time.Minute)).Code)
+	require.Equal(t, http.StatusUnauthorized, request(assert("a@x.y.z", ikp, 0)).Code)
+	require.Equal(t, http.StatusUnauthorized, request(assert("a@x.y.z", ikp, -time.Minute)).Code)
+	// asserting a different email
+	uresp = request(assert("b@x.y.z", ikp, time.Minute))
+	require.Equal(t, http.StatusForbidden, uresp.Code)
+	require.Empty(t, uresp.Jwt)
+
+	areq := UserAccountsRequest{Email: "b@x.y.z", Identity: assert("a@x.y.z", ikp, time.Minute)}
+	r, err = nc.Request(SubjUserAccounts, ts.ToJSON(t, areq), time.Second)
+	require.NoError(t, err)
+	var aresp UserAccountsResponse
+	ts.FromJSON(t, r.Data, &aresp)
+	require.Equal(t, http.StatusForbidden, aresp.Code)
+	require.Empty(t, aresp.Accounts)
+
+	areq.Identity = assert("b@x.y.z", ikp, time.Minute)
+	r, err = nc.Request(SubjUserAccounts, ts.ToJSON(t, areq), time.Second)
+	require.NoError(t, err)
+	aresp = UserAccountsResponse{}
+	ts.FromJSON(t, r.Data, &aresp)
+	require.Empty(t, aresp.Error)
+	require.Equal(t, []string{ts.PublicKey(t, akp)}, aresp.Accounts)
+}
+
+func TestOIDCIdentity(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	idp := newTestIdP(t)
+	var cm CredentialsManager
+	cm.NatsHostPort = ts.ns.ClientURL()
+	cm.Store = NewMemoryStore()
+	cm.OIDCIssuer = "https://idp.example.com"
+	cm.OIDCAudience = "dashboard"
+	cm.OIDCJWKS = idp.WriteJWKS(t, ts.dir)
+	require.NoError(t, cm.Run())
+	defer cm.Stop()
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+
+	nc := ts.NatsClient(t, "driver")
+	var uac UpdateAccountRequest
+	uac.Jwt = ts.EncodeResolverConfig(t, rc, akp)
+	_, err := nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, uac), time.Second)
+	require.NoError(t, err)
+
+	// the email comes from the token
+	areq := UserAccountsRequest{IDToken: idp.Sign(t, "rsa", idTokenClaimsFor("a@x.y.z"))}
+	r, err := nc.Request(SubjUserAccounts, ts.ToJSON(t, areq), time.Second)
+	require.NoError(t, err)
+	var aresp UserAccountsResponse
+	ts.FromJSON(t, r.Data, &aresp)
+	require.Empty(t, aresp.Error)
+	require.Equal(t, "a@x.y.z", aresp.UserAccountsRequest.Email)
+	require.Empty(t, aresp.IDToken)
+	require.Equal(t, []string{ts.PublicKey(t, akp)}, aresp.Accounts)
+	require.NotEmpty(t, aresp.Jwt)
+
+	request := func(ureq UserRequest) UserResponse {
+		r, err := nc.Request(SubjGetUserJwt, ts.ToJSON(t, ureq), time.Second)
+		require.NoError(t, err)
+		var uresp UserResponse
+		ts.FromJSON(t, r.Data, &uresp)
+		return uresp
+	}
+	uresp := request(UserRequest{Account: ts.PublicKey(t, akp), IDToken: idp.Sign(t, "ec", idTokenClaimsFor("a@x.y.z"))})
+	require.Empty(t, uresp.Error)
+	require.NotEmpty(t, uresp.Jwt)
+
+	// a token is required, and must be for the requested email
+	require.Equal(t, http.StatusUnauthorized, request(UserRequest{Email: "a@x.y.z", Account: ts.PublicKey(t, akp)}).Code)
+	uresp = request(UserRequest{Email: "b@x.y.z", Account: ts.PublicKey(t, akp), IDToken: idp.Sign(t, "ec", idTokenClaimsFor("a@x.y.z"))})
+	require.Equal(t, http.StatusForbidden, uresp.Code)
+
+	claims := idTokenClaimsFor("a@x.y.z")
+	claims["email_verified"] = false
+	uresp = request(UserRequest{Account: ts.PublicKey(t, akp), IDToken: idp.Sign(t, "rsa", claims)})
+	require.Equal(t, http.StatusUnauthorized, uresp.Code)
+	require.Empty(t, uresp.Jwt)
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	natsservertest "github.com/nats-io/nats-server/v2/test"
 
@@ -30,11 +32,19 @@ func NewCredentialsTestSetup(t *testing.T) *CredentialsTestSetup {
 
 	opts := natsservertest.DefaultTestOptions
 	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = filepath.Join(ts.dir, "jetstream")
 	ts.ns = natsservertest.RunServer(&opts)
 
 	return &ts
 }
 
+func (ts *CredentialsTestSetup) FileStore(t *testing.T) *StaticFileResolver {
+	sr, err := NewStaticResolver(ts.dir)
+	require.NoError(t, err)
+	return sr
+}
+
 func (ts *CredentialsTestSetup) NatsClient(t *testing.T, name string) *nats.Conn {
 	opts := nats.Options{}
 	opts.Url = ts.ns.ClientURL()
@@ -115,12 +125,32 @@ func (ts *CredentialsTestSetup) Encode(t *testing.T, c jwt.Claims, kp nkeys.KeyP
 	return token
 }
 
+// RequestToken returns a single use request token of the type signed
+// by the account
+func (ts *CredentialsTestSetup) RequestToken(t *testing.T, akp nkeys.KeyPair, typ string) string {
+	gc := jwt.NewGenericClaims(ts.PublicKey(t, akp))
+	gc.Type = jwt.ClaimType(typ)
+	// the name makes the jti unique
+	gc.Name = ts.PublicKey(t, ts.CreateUserPair(t))
+	gc.Expires = time.Now().Add(time.Minute).Unix()
+	return ts.Encode(t, gc, akp)
+}
+
 func (ts *CredentialsTestSetup) EncodeResolverConfig(t *testing.T, rc ResolverConfig, kp nkeys.KeyPair) string {
 	token, err := rc.Encode(kp)
 	require.NoError(t, err)
 	return token
 }
 
+func (ts *CredentialsTestSetup) ResolverConfigClaims(t *testing.T, rc ResolverConfig, kp nkeys.KeyPair) *jwt.GenericClaims {
+	gc := jwt.NewGenericClaims(ts.PublicKey(t, kp))
+	gc.Type = DashboardConfigurationType
+	var err error
+	gc.Data, err = rc.Map()
+	require.NoError(t, err)
+	return gc
+}
+
 func (ts *CredentialsTestSetup) CreateResolverConfig(t *testing.T, kind ResolverType) ResolverConfig {
 	var rc ResolverConfig
 	rc.Kind = kind
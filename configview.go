@@ -0,0 +1,94 @@
+package cm
+
+import (
+	jwtv2 "github.com/nats-io/jwt/v2"
+)
+
+// ConfigView is an account configuration with the generator signing
+// keys replaced by their public keys
+type ConfigView struct {
+	Account   string       `json:"account"`
+	ID        string       `json:"jti"`
+	IssuedAt  int64        `json:"iat"`
+	Expires   int64        `json:"exp,omitempty"`
+	NotBefore int64        `json:"nbf,omitempty"`
+	Kind      ResolverType `json:"kind"`
+	Users     Users        `json:"users,omitempty"`
+	Groups    Groups       `json:"groups,omitempty"`
+	Roles     []RoleView   `json:"roles,omitempty"`
+	// DefaultTTL is the lifetime in seconds of generated user JWTs
+	// for roles that don't specify one
+	DefaultTTL int64 `json:"default_ttl,omitempty"`
+}
+
+// RoleView is a generator role without its signing key seed
+type RoleView struct {
+	Role UserRole `json:"role"`
+	Rank int      `json:"rank,omitempty"`
+	// SigningKey is the public key of the signing key
+	SigningKey string `json:"signing_key"`
+	// Sealed is set if the seed is sealed for the credentials manager
+	Sealed bool `json:"sealed,omitempty"`
+	// External is set if the key is held by the signer
+	External bool `json:"external,omitempty"`
+
+	Pub     []string                  `json:"pub_permissions"`
+	Sub     []string                  `json:"sub_permissions"`
+	PubDeny []string                  `json:"pub_deny,omitempty"`
+	SubDeny []string                  `json:"sub_deny,omitempty"`
+	Resp    *jwtv2.ResponsePermission `json:"resp,omitempty"`
+	Limits  RoleLimits                `json:"limits,omitempty"`
+	Tags    []string                  `json:"tags,omitempty"`
+	TTL     int64                     `json:"ttl,omitempty"`
+	Creds   bool                      `json:"creds,omitempty"`
+}
+
+// View returns the configuration without signing key seeds
+func (c *Config) View() (*ConfigView, error) {
+	v := ConfigView{
+		Account:   c.Account,
+		ID:        c.ID,
+		IssuedAt:  c.IssuedAt,
+		Expires:   c.Expires,
+		NotBefore: c.NotBefore,
+		Kind:      c.Kind,
+		Users:     c.Users,
+		Groups:    c.Groups,
+	}
+	if c.GeneratorConfig == nil {
+		return &v, nil
+	}
+	v.DefaultTTL = c.GeneratorConfig.DefaultTTL
+	for _, r := range c.GeneratorConfig.Roles {
+		pk, err := r.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		v.Roles = append(v.Roles, RoleView{
+			Role:       r.Role,
+			Rank:       r.Rank,
+			SigningKey: pk,
+			Sealed:     r.SealedSigningKey != nil,
+			External:   r.ExternalSigningKey != nil,
+			Pub:        r.Pub,
+			Sub:        r.Sub,
+			PubDeny:    r.PubDeny,
+			SubDeny:    r.SubDeny,
+			Resp:       r.Resp,
+			Limits:     r.Limits,
+			Tags:       r.Tags,
+			TTL:        r.TTL,
+			Creds:      r.Creds,
+		})
+	}
+	return &v, nil
+}
+
+// configView returns the view of the configuration JWT
+func configView(token []byte) (*ConfigView, error) {
+	c, err := decodeConfig(token)
+	if err != nil {
+		return nil, err
+	}
+	return c.View()
+}
@@ -1,9 +1,11 @@
 package cm
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
-	"github.com/nats-io/jwt"
+	jwtv2 "github.com/nats-io/jwt/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -11,7 +13,7 @@ func TestGeneratorResolver(t *testing.T) {
 	ts := NewCredentialsTestSetup(t)
 	defer ts.Cleanup(t)
 
-	be := NewBackend(ts.dir)
+	be := NewBackend(ts.FileStore(t))
 	require.NoError(t, be.Start())
 
 	var rc ResolverConfig
@@ -36,7 +38,7 @@ func TestGeneratorResolver(t *testing.T) {
 
 	token, err := config.GetUserJwt("a@x.y.c")
 	require.NoError(t, err)
-	uc, err := jwt.DecodeUserClaims(string(token))
+	uc, err := jwtv2.DecodeUserClaims(string(token))
 	require.NoError(t, err)
 	okp, err := owner.KeyPair()
 	require.NoError(t, err)
@@ -45,10 +47,172 @@ func TestGeneratorResolver(t *testing.T) {
 
 	token, err = config.GetUserJwt("b@x.y.c")
 	require.NoError(t, err)
-	uc, err = jwt.DecodeUserClaims(string(token))
+	uc, err = jwtv2.DecodeUserClaims(string(token))
 	require.NoError(t, err)
 	okp, err = manager.KeyPair()
 	require.NoError(t, err)
 	require.Equal(t, ts.PublicKey(t, okp), uc.Issuer)
 	require.Equal(t, ts.PublicKey(t, akp), uc.IssuerAccount)
 }
+
+func TestGeneratorUserJwtTTL(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	var rc ResolverConfig
+	rc.Kind = Generator
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+	rc.Users = append(rc.Users, ts.MakeUserConfig("b@x.y.c", Manager))
+
+	var gc GeneratorConfig
+	owner := ts.MakeRolePerm(t, Owner, []string{"dashboard.>"})
+	owner.TTL = 60
+	gc.AddRole(owner)
+	gc.AddRole(ts.MakeRolePerm(t, Manager, []string{"dashboard.manager.>"}))
+	rc.ResolverOptions = gc
+
+	akp := ts.CreateAccountPair(t)
+	config, err := ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+
+	expires := func(email string) time.Duration {
+		token, err := config.GetUserJwt(email)
+		require.NoError(t, err)
+		uc, err := jwtv2.DecodeUserClaims(string(token))
+		require.NoError(t, err)
+		return time.Until(time.Unix(uc.Expires, 0))
+	}
+	// role ttl
+	require.InDelta(t, time.Minute, expires("a@x.y.c"), float64(2*time.Second))
+	// package default
+	require.InDelta(t, DefaultUserJwtTTL, expires("b@x.y.c"), float64(2*time.Second))
+
+	// generator default
+	gc.DefaultTTL = 3600
+	rc.ResolverOptions = gc
+	config, err = ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	require.InDelta(t, time.Hour, expires("b@x.y.c"), float64(2*time.Second))
+	require.InDelta(t, time.Minute, expires("a@x.y.c"), float64(2*time.Second))
+
+	owner.TTL = -1
+	require.Error(t, gc.AddRole(owner))
+}
+
+func TestGeneratorRoleCreds(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	var rc ResolverConfig
+	rc.Kind = Generator
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+	rc.Users = append(rc.Users, ts.MakeUserConfig("b@x.y.c", Manager))
+
+	var gc GeneratorConfig
+	owner := ts.MakeRolePerm(t, Owner, []string{"dashboard.>"})
+	owner.Creds = true
+	gc.AddRole(owner)
+	gc.AddRole(ts.MakeRolePerm(t, Manager, []string{"dashboard.manager.>"}))
+	rc.ResolverOptions = gc
+
+	config, err := ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, ts.CreateAccountPair(t))))
+	require.NoError(t, err)
+
+	token, creds, err := config.GetUserCreds("a@x.y.c", false)
+	require.NoError(t, err)
+	require.NotNil(t, creds)
+	uc, err := jwtv2.DecodeUserClaims(string(token))
+	require.NoError(t, err)
+	require.False(t, uc.BearerToken)
+
+	token, creds, err = config.GetUserCreds("b@x.y.c", false)
+	require.NoError(t, err)
+	require.Nil(t, creds)
+	uc, err = jwtv2.DecodeUserClaims(string(token))
+	require.NoError(t, err)
+	require.True(t, uc.BearerToken)
+}
+
+func TestGeneratorRoleLimits(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	var rc ResolverConfig
+	rc.Kind = Generator
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Monitor))
+
+	var gc GeneratorConfig
+	monitor := ts.MakeRolePerm(t, Monitor, []string{"dashboard.>"})
+	monitor.PubDeny = []string{"dashboard.admin.>"}
+	monitor.SubDeny = []string{"dashboard.users.{{email_hash}}.private"}
+	monitor.Resp = &jwtv2.ResponsePermission{MaxMsgs: 1, Expires: time.Second}
+	monitor.Limits = RoleLimits{Subs: 10, Data: 1 << 20, Payload: 1024, Src: jwtv2.CIDRList{"10.0.0.0/8"}, Times: []jwtv2.TimeRange{{Start: "08:00:00", End: "18:00:00"}}}
+	monitor.Tags = []string{"Dashboard", "monitor"}
+	require.NoError(t, gc.AddRole(monitor))
+	rc.ResolverOptions = gc
+
+	// the role is stored in the configuration JWT
+	config, err := ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, ts.CreateAccountPair(t))))
+	require.NoError(t, err)
+	token, err := config.GetUserJwt("a@x.y.c")
+	require.NoError(t, err)
+	uc, err := jwtv2.DecodeUserClaims(string(token))
+	require.NoError(t, err)
+
+	require.Equal(t, jwtv2.StringList{"dashboard.>"}, uc.Pub.Allow)
+	require.Equal(t, jwtv2.StringList{"dashboard.admin.>"}, uc.Pub.Deny)
+	require.Len(t, uc.Sub.Deny, 1)
+	require.NotContains(t, uc.Sub.Deny[0], "{{")
+	require.Equal(t, monitor.Resp, uc.Resp)
+	require.Equal(t, int64(10), uc.Subs)
+	require.Equal(t, int64(1<<20), uc.Data)
+	require.Equal(t, int64(1024), uc.Limits.Payload)
+	require.Equal(t, monitor.Limits.Src, uc.Src)
+	require.Equal(t, monitor.Limits.Times, uc.Times)
+	require.Equal(t, jwtv2.TagList{"dashboard", "monitor"}, uc.Tags)
+	require.True(t, uc.BearerToken)
+
+	// invalid limits fail validation
+	bad := ts.MakeRolePerm(t, Manager, nil)
+	bad.Limits.Src = jwtv2.CIDRList{"not a cidr"}
+	require.Error(t, gc.AddRole(bad))
+	gc.Roles = gc.Roles[:1]
+	bad = ts.MakeRolePerm(t, Manager, nil)
+	bad.Limits.Times = []jwtv2.TimeRange{{Start: "25:00:00", End: "18:00:00"}}
+	require.Error(t, gc.AddRole(bad))
+	gc.Roles = gc.Roles[:1]
+	bad = ts.MakeRolePerm(t, Manager, nil)
+	bad.PubDeny = []string{"{{nope}}"}
+	require.Error(t, gc.AddRole(bad))
+	gc.Roles = gc.Roles[:1]
+
+	bad = ts.MakeRolePerm(t, Manager, nil)
+	bad.Limits.Data = -1
+	require.Error(t, gc.AddRole(bad))
+	gc.Roles = gc.Roles[:1]
+
+	// the v1 max limit is ignored by the server, so it's rejected
+	bad = ts.MakeRolePerm(t, Manager, nil)
+	bad.Limits.Max = 100
+	require.Error(t, gc.AddRole(bad))
+	rc.ResolverOptions = gc
+	_, err = ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, ts.CreateAccountPair(t))))
+	require.ErrorContains(t, err, "max")
+
+	// unset limits are unlimited
+	gc.Roles = gc.Roles[:1]
+	gc.Roles[0].Limits = RoleLimits{}
+	rc.ResolverOptions = gc
+	config, err = ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, ts.CreateAccountPair(t))))
+	require.NoError(t, err)
+	token, err = config.GetUserJwt("a@x.y.c")
+	require.NoError(t, err)
+	uc, err = jwtv2.DecodeUserClaims(string(token))
+	require.NoError(t, err)
+	require.True(t, uc.Limits.IsUnlimited())
+
+	// src can also be a comma separated list
+	var l RoleLimits
+	require.NoError(t, json.Unmarshal([]byte(`{"src":"10.0.0.0/8,192.168.0.0/16"}`), &l))
+	require.Equal(t, jwtv2.CIDRList{"10.0.0.0/8", "192.168.0.0/16"}, l.Src)
+}
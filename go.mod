@@ -1,11 +1,26 @@
 module github.com/aricart/cm
 
-go 1.14
+go 1.21.0
 
 require (
 	github.com/nats-io/jwt v1.2.0
-	github.com/nats-io/nats-server/v2 v2.1.8-0.20201123174437-c0bc788c6dd5
-	github.com/nats-io/nats.go v1.10.1-0.20201116170459-93be3c8e717b
-	github.com/nats-io/nkeys v0.2.0
-	github.com/stretchr/testify v1.6.1
+	github.com/nats-io/jwt/v2 v2.5.8
+	github.com/nats-io/nats-server/v2 v2.10.22
+	github.com/nats-io/nats.go v1.37.0
+	github.com/nats-io/nkeys v0.4.7
+	github.com/stretchr/testify v1.7.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/klauspost/compress v1.17.11 // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/minio/highwayhash v1.0.3 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.28.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/time v0.7.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
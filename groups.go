@@ -0,0 +1,138 @@
+package cm
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Groups assign a role to many users. A user is a member of a group
+// if it is listed in Members, or is a member of one of the groups
+// listed in Groups. Members can be emails or user patterns.
+type Groups []Group
+type Group struct {
+	Name    string   `json:"name"`
+	Role    UserRole `json:"role,omitempty"`
+	Members []string `json:"members,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+}
+
+func (g Groups) get(name string) *Group {
+	for i := range g {
+		if g[i].Name == name {
+			return &g[i]
+		}
+	}
+	return nil
+}
+
+// hasMember returns true if the email is a member of the group or any
+// of its nested groups
+func (g Groups) hasMember(group *Group, email string, visited map[string]bool) bool {
+	if visited[group.Name] {
+		return false
+	}
+	visited[group.Name] = true
+	for _, m := range group.Members {
+		m = strings.ToLower(m)
+		if m == email {
+			return true
+		}
+		if IsUserPattern(m) {
+			if ok, _ := path.Match(m, email); ok {
+				return true
+			}
+		}
+	}
+	for _, n := range group.Groups {
+		if ng := g.get(n); ng != nil && g.hasMember(ng, email, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// role returns the strongest role of the groups the email is a member of
+func (g Groups) role(email string, stronger func(a UserRole, b UserRole) bool) UserRole {
+	var role UserRole
+	for i := range g {
+		if stronger(g[i].Role, role) && g.hasMember(&g[i], email, make(map[string]bool)) {
+			role = g[i].Role
+		}
+	}
+	return role
+}
+
+// members returns the members listed by all groups
+func (g Groups) members() StringList {
+	var a StringList
+	for _, i := range g {
+		for _, m := range i.Members {
+			a.Add(strings.ToLower(m))
+		}
+	}
+	return a
+}
+
+func (g Groups) Validate() error {
+	names := make(map[string]bool)
+	for _, i := range g {
+		if i.Name == "" {
+			return fmt.Errorf("group name is required")
+		}
+		if names[i.Name] {
+			return fmt.Errorf("group %s is multiply defined", i.Name)
+		}
+		names[i.Name] = true
+		if i.Role != "" {
+			if err := i.Role.Validate(); err != nil {
+				return fmt.Errorf("group %s: %v", i.Name, err)
+			}
+		}
+		for _, m := range i.Members {
+			if err := validateEmail(m); err != nil {
+				return fmt.Errorf("group %s: %v", i.Name, err)
+			}
+			if IsUserPattern(m) {
+				if err := validateUserPattern(m); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, i := range g {
+		for _, n := range i.Groups {
+			if !names[n] {
+				return fmt.Errorf("group %s references undefined group %s", i.Name, n)
+			}
+		}
+	}
+	// groups are visited once done, and are in progress while their
+	// nested groups are being visited
+	done := make(map[string]bool)
+	progress := make(map[string]bool)
+	var visit func(name string) error
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		if progress[name] {
+			return fmt.Errorf("group %s is circular", name)
+		}
+		progress[name] = true
+		for _, n := range g.get(name).Groups {
+			if err := visit(n); err != nil {
+				return err
+			}
+		}
+		progress[name] = false
+		done[name] = true
+		return nil
+	}
+	for _, i := range g {
+		if err := visit(i.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
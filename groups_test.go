@@ -0,0 +1,74 @@
+package cm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupRoles(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("lead@x.y.z", Monitor))
+	rc.Groups = Groups{
+		{Name: "admins", Role: Owner, Groups: []string{"leads"}},
+		{Name: "leads", Members: []string{"Lead@x.y.z"}},
+		{Name: "ops", Role: Manager, Members: []string{"ops@x.y.z", "lead@x.y.z"}},
+		{Name: "everyone", Role: Monitor, Members: []string{"*@x.y.z"}, Groups: []string{"ops"}},
+	}
+	c, err := ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+
+	role := func(email string) UserRole {
+		r, ok := c.userRole(email)
+		require.True(t, ok, email)
+		return r
+	}
+	// the strongest membership wins, including through nested groups
+	require.Equal(t, Owner, role("lead@x.y.z"))
+	require.Equal(t, Manager, role("ops@x.y.z"))
+	require.Equal(t, Monitor, role("someone@x.y.z"))
+	require.False(t, c.HasUser("someone@a.b.c"))
+	require.ElementsMatch(t, []string{"lead@x.y.z", "ops@x.y.z", "*@x.y.z"}, c.ListUsers())
+
+	token, err := c.GetUserJwt("ops@x.y.z")
+	require.NoError(t, err)
+	require.NotNil(t, token)
+
+	// group members are discoverable
+	store := NewMemoryStore()
+	_, err = store.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	accounts, err := store.GetUserAccounts("ops@x.y.z")
+	require.NoError(t, err)
+	require.Equal(t, []string{ts.PublicKey(t, akp)}, accounts)
+}
+
+func TestGroupValidation(t *testing.T) {
+	require.NoError(t, Groups{{Name: "a", Role: Owner, Groups: []string{"b"}}, {Name: "b"}}.Validate())
+
+	require.Error(t, Groups{{Name: ""}}.Validate())
+	require.Error(t, Groups{{Name: "a"}, {Name: "a"}}.Validate())
+	require.Error(t, Groups{{Name: "a", Role: "not a role"}}.Validate())
+	require.Error(t, Groups{{Name: "a", Groups: []string{"b"}}}.Validate())
+	require.Error(t, Groups{{Name: "a", Groups: []string{"a"}}}.Validate())
+	require.Error(t, Groups{
+		{Name: "a", Groups: []string{"b"}},
+		{Name: "b", Groups: []string{"c"}},
+		{Name: "c", Groups: []string{"a"}},
+	}.Validate())
+	require.Error(t, Groups{{Name: "a", Members: []string{"[a-"}}}.Validate())
+}
+
+func TestStaticConfigRejectsGroups(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	rc := ts.CreateResolverConfig(t, Static)
+	rc.Groups = Groups{{Name: "a", Role: Owner, Members: []string{"a@x.y.z"}}}
+	_, err := ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, ts.CreateAccountPair(t))))
+	require.Error(t, err)
+}
@@ -0,0 +1,72 @@
+package cm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nkeys"
+)
+
+// IdentityAssertionType is the claim type of identity assertions
+const IdentityAssertionType = "dashboard-identity-assertion"
+
+// ErrIdentityRequired is returned when a request doesn't carry an identity assertion
+var ErrIdentityRequired = errors.New("identity assertion required")
+
+// IdentityVerifier verifies an identity assertion and returns the email it asserts
+type IdentityVerifier interface {
+	VerifyIdentity(token string) (string, error)
+}
+
+// NKeyIdentityVerifier verifies identity assertions issued by a login
+// service as a JWT of type IdentityAssertionType signed by one of the
+// issuer keys. The subject of the assertion is the user's email, and
+// assertions must expire.
+type NKeyIdentityVerifier struct {
+	issuers StringList
+}
+
+func NewNKeyIdentityVerifier(issuers ...string) (*NKeyIdentityVerifier, error) {
+	var v NKeyIdentityVerifier
+	for _, i := range issuers {
+		i = strings.ToUpper(strings.TrimSpace(i))
+		if _, err := nkeys.FromPublicKey(i); err != nil {
+			return nil, fmt.Errorf("%q is not a valid issuer key", i)
+		}
+		v.issuers.Add(i)
+	}
+	if len(v.issuers) == 0 {
+		return nil, errors.New("no identity issuers")
+	}
+	return &v, nil
+}
+
+func (v *NKeyIdentityVerifier) VerifyIdentity(token string) (string, error) {
+	claim, err := jwt.DecodeGeneric(token)
+	if err != nil {
+		return "", err
+	}
+	if claim.Type != IdentityAssertionType {
+		return "", fmt.Errorf("bad claim type - %q", claim.Type)
+	}
+	if !v.issuers.Contains(claim.Issuer) {
+		return "", fmt.Errorf("untrusted identity issuer %s", claim.Issuer)
+	}
+	now := time.Now().Unix()
+	if claim.Expires == 0 {
+		return "", errors.New("identity assertion doesn't expire")
+	}
+	if now > claim.Expires {
+		return "", errors.New("identity assertion is expired")
+	}
+	if claim.NotBefore > 0 && claim.NotBefore > now {
+		return "", errors.New("identity assertion is not yet valid")
+	}
+	if claim.Subject == "" {
+		return "", errors.New("identity assertion has no subject")
+	}
+	return strings.ToLower(claim.Subject), nil
+}
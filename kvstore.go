@@ -0,0 +1,410 @@
+package cm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const KVConfigsBucket = "cm_configs"
+const KVUsersBucket = "cm_users"
+const KVIndexBucket = "cm_index"
+const KVRevisionsBucket = "cm_revisions"
+
+// KVStore is a Store that keeps account configurations and static
+// user JWTs in JetStream key-value buckets, so that multiple credential
+// managers can share the same data. Keys mirror the sharded layout of
+// the StaticFileResolver: configs are stored as `<shard>.<account>` and
+// user JWTs as `<shard>.<email>.<account>`, where the email is encoded
+// to be a valid key token. The accounts listing an email are indexed
+// under `<shard>.<email>`, and configuration revisions are kept
+// as `<shard>.<account>.<revision>`.
+type KVStore struct {
+	configs   nats.KeyValue
+	users     nats.KeyValue
+	index     nats.KeyValue
+	revisions nats.KeyValue
+}
+
+func NewKVStore(nc *nats.Conn) (*KVStore, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	var r KVStore
+	if r.configs, err = r.bucket(js, KVConfigsBucket); err != nil {
+		return nil, err
+	}
+	if r.users, err = r.bucket(js, KVUsersBucket); err != nil {
+		return nil, err
+	}
+	if r.index, err = r.bucket(js, KVIndexBucket); err != nil {
+		return nil, err
+	}
+	if r.revisions, err = r.bucket(js, KVRevisionsBucket); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (r *KVStore) bucket(js nats.JetStreamContext, name string) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(name)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return js.CreateKeyValue(&nats.KeyValueConfig{Bucket: name})
+	}
+	return kv, err
+}
+
+func (r *KVStore) StoreAccountConfig(token []byte) (*Config, error) {
+	nc, err := ParseConfig(token)
+	if err != nil {
+		return nc, err
+	}
+	e, err := r.get(r.configs, r.configKey(nc.Account))
+	if err != nil {
+		return nc, err
+	}
+	var current []byte
+	if e != nil {
+		current = e.Value()
+	}
+	revisions, err := r.ListConfigRevisions(nc.Account)
+	if err != nil {
+		return nc, err
+	}
+	if err := checkConfigOrder(nc, token, current, revisions); err != nil {
+		return nc, err
+	}
+	return nc, r.storeConfig(nc, token, e)
+}
+
+// storeConfig replaces the account configuration read as the entry,
+// which is nil if there was none, and records it as a new revision
+func (r *KVStore) storeConfig(nc *Config, token []byte, e nats.KeyValueEntry) error {
+	var oc *Config
+	var err error
+	if e != nil {
+		oc = rawConfig(e.Value())
+	}
+	// fail if another instance updated the config since we read it
+	if e == nil {
+		_, err = r.configs.Create(r.configKey(nc.Account), token)
+	} else {
+		_, err = r.configs.Update(r.configKey(nc.Account), token, e.Revision())
+	}
+	if err != nil {
+		return err
+	}
+	// if we have an old static config, but new one is different
+	if oc != nil && oc.Kind == Static {
+		// if changed type delete all users
+		if oc.Kind != nc.Kind {
+			err = r.deleteUserJwts(oc.Account, oc.Users)
+		} else {
+			err = r.deleteUserJwts(oc.Account, nc.Users.Deleted(oc.Users))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	revisions, err := r.listRevisions(nc.Account)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(revisions) > 0 {
+		next = revisions[len(revisions)-1] + 1
+	}
+	if _, err := r.revisions.Create(r.revisionKey(nc.Account, next), token); err != nil {
+		return err
+	}
+	added, removed := indexChanges(oc, nc)
+	for _, e := range removed {
+		if err := r.updateIndex(e, func(a *StringList) { a.Remove(nc.Account) }); err != nil {
+			return err
+		}
+	}
+	for _, e := range added {
+		if err := r.updateIndex(e, func(a *StringList) { a.Add(nc.Account) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *KVStore) StoreUserJwt(token []byte) error {
+	uc, err := jwt.DecodeUserClaims(string(token))
+	if err != nil {
+		return fmt.Errorf("unable to decode user JWT: %v", err)
+	}
+	// associate the user with the account that generated the JWT
+	id := uc.Issuer
+	if uc.IssuerAccount != "" {
+		id = uc.IssuerAccount
+	}
+	// the id names the user JWT, and is not validated by the decoder
+	if !nkeys.IsValidPublicAccountKey(id) {
+		return fmt.Errorf("user JWT issuer account %q is not an account key", id)
+	}
+	// the "email" should be the uc.Name or it won't be found
+	_, err = r.users.Put(r.userKey(uc.Name, id), token)
+	return err
+}
+
+func (r *KVStore) GetConfig(account string) ([]byte, error) {
+	account = strings.ToUpper(account)
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return nil, errors.New("not account key")
+	}
+	e, err := r.get(r.configs, r.configKey(account))
+	if err != nil || e == nil {
+		return nil, err
+	}
+	return e.Value(), nil
+}
+
+func (r *KVStore) GetUserJwt(email string, account string) ([]byte, error) {
+	account = strings.ToUpper(account)
+	ad, err := r.GetConfig(account)
+	if err != nil || ad == nil {
+		return nil, err
+	}
+	c, err := loadConfig(ad)
+	if err != nil {
+		return nil, err
+	}
+	// even if we have a JWT, we won't release it unless the config says we do
+	if c.Kind != Static || !c.HasUser(email) {
+		return nil, nil
+	}
+	e, err := r.get(r.users, r.userKey(email, account))
+	if err != nil || e == nil {
+		return nil, err
+	}
+	return e.Value(), nil
+}
+
+func (r *KVStore) GetUserAccounts(email string) ([]string, error) {
+	if IsUserPattern(email) {
+		return nil, nil
+	}
+	found, err := r.readIndex(email)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := r.readIndex(PatternIndexKey)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := patternAccounts(email, candidates, r.GetConfig)
+	if err != nil {
+		return nil, err
+	}
+	var accounts StringList
+	accounts.Add(found...)
+	accounts.Add(matches...)
+	return accounts, nil
+}
+
+// readIndex returns the accounts indexed under the key
+func (r *KVStore) readIndex(key string) ([]string, error) {
+	e, err := r.get(r.index, r.indexKey(key))
+	if err != nil || e == nil {
+		return nil, err
+	}
+	var accounts []string
+	if err := json.Unmarshal(e.Value(), &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (r *KVStore) ListAccounts() ([]string, error) {
+	keys, err := r.keys(r.configs, ">")
+	if err != nil {
+		return nil, err
+	}
+	var accounts []string
+	for _, k := range keys {
+		accounts = append(accounts, k[strings.LastIndex(k, ".")+1:])
+	}
+	return accounts, nil
+}
+
+func (r *KVStore) ListConfigRevisions(account string) ([]ConfigRevision, error) {
+	account = strings.ToUpper(account)
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return nil, errors.New("not account key")
+	}
+	revisions, err := r.listRevisions(account)
+	if err != nil {
+		return nil, err
+	}
+	var list []ConfigRevision
+	for _, n := range revisions {
+		d, err := r.GetConfigRevision(account, n)
+		if err != nil {
+			return nil, err
+		}
+		cr, err := NewConfigRevision(n, d)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, cr)
+	}
+	return list, nil
+}
+
+func (r *KVStore) GetConfigRevision(account string, revision int) ([]byte, error) {
+	account = strings.ToUpper(account)
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return nil, errors.New("not account key")
+	}
+	e, err := r.get(r.revisions, r.revisionKey(account, revision))
+	if err != nil || e == nil {
+		return nil, err
+	}
+	return e.Value(), nil
+}
+
+func (r *KVStore) RollbackConfig(account string, revision int) (*Config, error) {
+	e, err := r.get(r.configs, r.configKey(strings.ToUpper(account)))
+	if err != nil {
+		return nil, err
+	}
+	d, err := r.GetConfigRevision(account, revision)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, fmt.Errorf("revision %d not found", revision)
+	}
+	c, err := ParseConfig(d)
+	if err != nil {
+		return nil, err
+	}
+	return c, r.storeConfig(c, d, e)
+}
+
+// listRevisions returns the sorted revision numbers stored for the account
+func (r *KVStore) listRevisions(account string) ([]int, error) {
+	keys, err := r.keys(r.revisions, r.configKey(account)+".*")
+	if err != nil {
+		return nil, err
+	}
+	var revisions []int
+	for _, k := range keys {
+		n, err := strconv.Atoi(k[strings.LastIndex(k, ".")+1:])
+		if err == nil {
+			revisions = append(revisions, n)
+		}
+	}
+	sort.Ints(revisions)
+	return revisions, nil
+}
+
+func (r *KVStore) deleteUserJwts(account string, users Users) error {
+	for _, i := range users {
+		if err := r.users.Delete(r.userKey(i.Email, account)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateIndex applies the change to the index entry for the email,
+// retrying if another instance modified the entry concurrently
+func (r *KVStore) updateIndex(email string, change func(*StringList)) error {
+	key := r.indexKey(email)
+	for {
+		e, err := r.get(r.index, key)
+		if err != nil {
+			return err
+		}
+		var accounts StringList
+		if e != nil {
+			if err := json.Unmarshal(e.Value(), &accounts); err != nil {
+				return err
+			}
+		}
+		change(&accounts)
+		d, err := json.Marshal(accounts)
+		if err != nil {
+			return err
+		}
+		switch {
+		case e == nil:
+			_, err = r.index.Create(key, d)
+		case len(accounts) == 0:
+			err = r.index.Delete(key, nats.LastRevision(e.Revision()))
+		default:
+			_, err = r.index.Update(key, d, e.Revision())
+		}
+		if !errors.Is(err, nats.ErrKeyExists) {
+			return err
+		}
+	}
+}
+
+// get returns the entry for the key or nil if not found
+func (r *KVStore) get(kv nats.KeyValue, key string) (nats.KeyValueEntry, error) {
+	e, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, nil
+	}
+	return e, err
+}
+
+// keys returns the keys in the bucket matching the filter
+func (r *KVStore) keys(kv nats.KeyValue, filter string) ([]string, error) {
+	w, err := kv.Watch(filter, nats.IgnoreDeletes(), nats.MetaOnly())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+	var keys []string
+	for e := range w.Updates() {
+		// a nil entry marks the end of the initial values
+		if e == nil {
+			break
+		}
+		keys = append(keys, e.Key())
+	}
+	return keys, nil
+}
+
+// configKey returns the key where an account configuration
+// would be found if it exists
+func (r *KVStore) configKey(account string) string {
+	return fmt.Sprintf("%s.%s", calcShard(account), account)
+}
+
+// revisionKey returns the key where a revision of the account
+// configuration would be found if it exists
+func (r *KVStore) revisionKey(account string, revision int) string {
+	return fmt.Sprintf("%s.%d", r.configKey(account), revision)
+}
+
+// indexKey returns the key listing the accounts whose configurations
+// include the email
+func (r *KVStore) indexKey(email string) string {
+	email = strings.ToLower(email)
+	enc := base64.RawURLEncoding.EncodeToString([]byte(email))
+	return fmt.Sprintf("%s.%s", calcShard(email), enc)
+}
+
+// userKey returns the key where the user JWT for the account
+// would be found if it exists
+func (r *KVStore) userKey(email string, account string) string {
+	email = strings.ToLower(email)
+	enc := base64.RawURLEncoding.EncodeToString([]byte(email))
+	return fmt.Sprintf("%s.%s.%s", calcShard(email), enc, account)
+}
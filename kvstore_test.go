@@ -0,0 +1,180 @@
+package cm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStoreUsers(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r, err := NewKVStore(ts.NatsClient(t, "kv"))
+	require.NoError(t, err)
+
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	d, err := r.GetConfig(apk)
+	require.NoError(t, err)
+	require.Nil(t, d)
+
+	userToken := ts.CreateUser(t, "Me@X.y.z", akp)
+	require.NoError(t, r.StoreUserJwt([]byte(userToken)))
+
+	// not released without a config listing the user
+	d, err = r.GetUserJwt("me@x.y.z", apk)
+	require.NoError(t, err)
+	require.Nil(t, d)
+
+	var rc ResolverConfig
+	rc.Users = append(rc.Users, ts.MakeUserConfig("me@x.y.z", Owner))
+	config := ts.EncodeResolverConfig(t, rc, akp)
+	_, err = r.StoreAccountConfig([]byte(config))
+	require.NoError(t, err)
+
+	d, err = r.GetConfig(apk)
+	require.NoError(t, err)
+	require.Equal(t, config, string(d))
+
+	accounts, err := r.ListAccounts()
+	require.NoError(t, err)
+	require.Equal(t, []string{apk}, accounts)
+
+	accounts, err = r.GetUserAccounts("ME@x.y.z")
+	require.NoError(t, err)
+	require.Equal(t, []string{apk}, accounts)
+
+	d, err = r.GetUserJwt("me@X.Y.Z", apk)
+	require.NoError(t, err)
+	require.Equal(t, userToken, string(d))
+
+	// removing the user from the config deletes the static JWT
+	rc.Users = nil
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	e, err := r.get(r.users, r.userKey("me@x.y.z", apk))
+	require.NoError(t, err)
+	require.Nil(t, e)
+
+	accounts, err = r.GetUserAccounts("me@x.y.z")
+	require.NoError(t, err)
+	require.Empty(t, accounts)
+}
+
+func TestKVStoreShared(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	// two credential managers sharing the same buckets
+	var cma CredentialsManager
+	cma.NatsHostPort = ts.ns.ClientURL()
+	cma.JetStream = true
+	require.NoError(t, cma.Run())
+	defer cma.Stop()
+
+	var cmb CredentialsManager
+	cmb.NatsHostPort = ts.ns.ClientURL()
+	cmb.JetStream = true
+	require.NoError(t, cmb.Run())
+	defer cmb.Stop()
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Static)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	config := ts.EncodeResolverConfig(t, rc, akp)
+	require.NoError(t, cma.backend.UpdateAccountConfig([]byte(config)))
+	token := ts.CreateUser(t, "a@x.y.z", akp)
+	require.NoError(t, cma.backend.AddUserJwt([]byte(token)))
+
+	nc := ts.NatsClient(t, "client")
+	ureq := UserRequest{Email: "a@x.y.z", Account: ts.PublicKey(t, akp)}
+	r, err := nc.Request(SubjGetUserJwt, ts.ToJSON(t, ureq), time.Second)
+	require.NoError(t, err)
+	var uresp UserResponse
+	ts.FromJSON(t, r.Data, &uresp)
+	require.Equal(t, token, uresp.Jwt)
+
+	d, err := cmb.backend.GetUserJwt(ts.PublicKey(t, akp), "a@x.y.z")
+	require.NoError(t, err)
+	require.Equal(t, token, string(d))
+}
+
+func TestKVStoreConcurrentUpdate(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	a, err := NewKVStore(ts.NatsClient(t, "a"))
+	require.NoError(t, err)
+	b, err := NewKVStore(ts.NatsClient(t, "b"))
+	require.NoError(t, err)
+
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	rc := ts.CreateResolverConfig(t, Static)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner), ts.MakeUserConfig("b@x.y.z", Manager))
+	_, err = a.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	require.NoError(t, a.StoreUserJwt([]byte(ts.CreateUser(t, "b@x.y.z", akp))))
+
+	// a checks an update removing b against the current config...
+	e, err := a.get(a.configs, a.configKey(apk))
+	require.NoError(t, err)
+	removed := rc
+	removed.Users = rc.Users[:1]
+	token := []byte(ts.EncodeResolverConfig(t, removed, akp))
+	nc, err := ParseConfig(token)
+	require.NoError(t, err)
+
+	// ...while b stores a newer one
+	added := rc
+	added.Users = append(append(Users{}, rc.Users...), ts.MakeUserConfig("c@x.y.z", Monitor))
+	newer := ts.EncodeResolverConfig(t, added, akp)
+	_, err = b.StoreAccountConfig([]byte(newer))
+	require.NoError(t, err)
+
+	// the older update fails and leaves the users of the newer config
+	require.Error(t, a.storeConfig(nc, token, e))
+	d, err := a.GetConfig(apk)
+	require.NoError(t, err)
+	require.Equal(t, newer, string(d))
+	d, err = a.GetUserJwt("b@x.y.z", apk)
+	require.NoError(t, err)
+	require.NotNil(t, d)
+}
+
+func TestKVStoreRevisions(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r, err := NewKVStore(ts.NatsClient(t, "kv"))
+	require.NoError(t, err)
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	var rc ResolverConfig
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	first := ts.EncodeResolverConfig(t, rc, akp)
+	_, err = r.StoreAccountConfig([]byte(first))
+	require.NoError(t, err)
+	rc.Users = nil
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+
+	revisions, err := r.ListConfigRevisions(apk)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	require.Equal(t, 2, revisions[1].Revision)
+
+	_, err = r.RollbackConfig(apk, 1)
+	require.NoError(t, err)
+	d, err := r.GetConfig(apk)
+	require.NoError(t, err)
+	require.Equal(t, first, string(d))
+	d, err = r.GetConfigRevision(apk, 3)
+	require.NoError(t, err)
+	require.Equal(t, first, string(d))
+	accounts, err := r.GetUserAccounts("a@x.y.z")
+	require.NoError(t, err)
+	require.Equal(t, []string{apk}, accounts)
+}
@@ -0,0 +1,43 @@
+package cm
+
+import "sync"
+
+// KeyLocks provides a mutex per key, so that operations on
+// different accounts can proceed concurrently while operations
+// on the same account are serialized.
+type KeyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock blocks until the lock for the key is acquired and
+// returns the function that releases it
+func (kl *KeyLocks) Lock(key string) func() {
+	kl.mu.Lock()
+	if kl.locks == nil {
+		kl.locks = make(map[string]*keyLock)
+	}
+	l := kl.locks[key]
+	if l == nil {
+		l = &keyLock{}
+		kl.locks[key] = l
+	}
+	l.refs++
+	kl.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		kl.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(kl.locks, key)
+		}
+		kl.mu.Unlock()
+	}
+}
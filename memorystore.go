@@ -0,0 +1,229 @@
+package cm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nkeys"
+)
+
+// MemoryStore is a Store that keeps all configurations and user JWTs
+// in memory. It is intended for tests and ephemeral deployments.
+type MemoryStore struct {
+	sync.Mutex
+	configs map[string][]byte
+	// revisions holds every accepted configuration, oldest first
+	revisions map[string][][]byte
+	// users maps a lower case email to its account JWTs
+	users map[string]map[string][]byte
+	// index maps a lower case email to the accounts listing it
+	index map[string]StringList
+}
+
+func NewMemoryStore() *MemoryStore {
+	var r MemoryStore
+	r.configs = make(map[string][]byte)
+	r.revisions = make(map[string][][]byte)
+	r.users = make(map[string]map[string][]byte)
+	r.index = make(map[string]StringList)
+	return &r
+}
+
+func (r *MemoryStore) StoreAccountConfig(token []byte) (*Config, error) {
+	nc, err := ParseConfig(token)
+	if err != nil {
+		return nc, err
+	}
+	r.Lock()
+	defer r.Unlock()
+	revisions, err := r.configRevisions(nc.Account)
+	if err != nil {
+		return nc, err
+	}
+	if err := checkConfigOrder(nc, token, r.configs[nc.Account], revisions); err != nil {
+		return nc, err
+	}
+	return nc, r.storeConfig(nc, token)
+}
+
+// storeConfig replaces the account configuration and records it
+// as a new revision, the caller is expected to hold the lock
+func (r *MemoryStore) storeConfig(nc *Config, token []byte) error {
+	var oc *Config
+	if otoken := r.configs[nc.Account]; otoken != nil {
+		oc = rawConfig(otoken)
+	}
+	// if we have an old static config, but new one is different
+	if oc != nil && oc.Kind == Static {
+		// if changed type delete all users
+		if oc.Kind != nc.Kind {
+			r.deleteUserJwts(oc.Account, oc.Users)
+		} else {
+			r.deleteUserJwts(oc.Account, nc.Users.Deleted(oc.Users))
+		}
+	}
+	r.configs[nc.Account] = token
+	r.revisions[nc.Account] = append(r.revisions[nc.Account], token)
+	added, removed := indexChanges(oc, nc)
+	for _, e := range removed {
+		accounts := r.index[e]
+		accounts.Remove(nc.Account)
+		if len(accounts) == 0 {
+			delete(r.index, e)
+		} else {
+			r.index[e] = accounts
+		}
+	}
+	for _, e := range added {
+		accounts := r.index[e]
+		accounts.Add(nc.Account)
+		r.index[e] = accounts
+	}
+	return nil
+}
+
+func (r *MemoryStore) StoreUserJwt(token []byte) error {
+	uc, err := jwt.DecodeUserClaims(string(token))
+	if err != nil {
+		return fmt.Errorf("unable to decode user JWT: %v", err)
+	}
+	// associate the user with the account that generated the JWT
+	id := uc.Issuer
+	if uc.IssuerAccount != "" {
+		id = uc.IssuerAccount
+	}
+	// the "email" should be the uc.Name or it won't be found
+	email := strings.ToLower(uc.Name)
+	r.Lock()
+	defer r.Unlock()
+	accounts := r.users[email]
+	if accounts == nil {
+		accounts = make(map[string][]byte)
+		r.users[email] = accounts
+	}
+	accounts[id] = token
+	return nil
+}
+
+func (r *MemoryStore) GetConfig(account string) ([]byte, error) {
+	account = strings.ToUpper(account)
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return nil, errors.New("not account key")
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.configs[account], nil
+}
+
+func (r *MemoryStore) GetUserJwt(email string, account string) ([]byte, error) {
+	account = strings.ToUpper(account)
+	ad, err := r.GetConfig(account)
+	if err != nil || ad == nil {
+		return nil, err
+	}
+	c, err := loadConfig(ad)
+	if err != nil {
+		return nil, err
+	}
+	// even if we have a JWT, we won't release it unless the config says we do
+	if c.Kind != Static || !c.HasUser(email) {
+		return nil, nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.users[strings.ToLower(email)][account], nil
+}
+
+func (r *MemoryStore) GetUserAccounts(email string) ([]string, error) {
+	email = strings.ToLower(email)
+	if IsUserPattern(email) {
+		return nil, nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	matches, err := patternAccounts(email, r.index[PatternIndexKey], func(account string) ([]byte, error) {
+		return r.configs[account], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var accounts StringList
+	accounts.Add(r.index[email]...)
+	accounts.Add(matches...)
+	return accounts, nil
+}
+
+func (r *MemoryStore) ListAccounts() ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	var accounts []string
+	for a := range r.configs {
+		accounts = append(accounts, a)
+	}
+	return accounts, nil
+}
+
+func (r *MemoryStore) ListConfigRevisions(account string) ([]ConfigRevision, error) {
+	account = strings.ToUpper(account)
+	r.Lock()
+	defer r.Unlock()
+	return r.configRevisions(account)
+}
+
+// configRevisions returns the revisions for the account,
+// the caller is expected to hold the lock
+func (r *MemoryStore) configRevisions(account string) ([]ConfigRevision, error) {
+	var list []ConfigRevision
+	for i, d := range r.revisions[account] {
+		cr, err := NewConfigRevision(i+1, d)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, cr)
+	}
+	return list, nil
+}
+
+func (r *MemoryStore) GetConfigRevision(account string, revision int) ([]byte, error) {
+	account = strings.ToUpper(account)
+	r.Lock()
+	defer r.Unlock()
+	return r.revision(account, revision), nil
+}
+
+func (r *MemoryStore) RollbackConfig(account string, revision int) (*Config, error) {
+	account = strings.ToUpper(account)
+	r.Lock()
+	defer r.Unlock()
+	d := r.revision(account, revision)
+	if d == nil {
+		return nil, fmt.Errorf("revision %d not found", revision)
+	}
+	c, err := ParseConfig(d)
+	if err != nil {
+		return nil, err
+	}
+	return c, r.storeConfig(c, d)
+}
+
+func (r *MemoryStore) revision(account string, revision int) []byte {
+	revisions := r.revisions[account]
+	if revision < 1 || revision > len(revisions) {
+		return nil
+	}
+	return revisions[revision-1]
+}
+
+func (r *MemoryStore) deleteUserJwts(account string, users Users) {
+	for _, i := range users {
+		email := strings.ToLower(i.Email)
+		accounts := r.users[email]
+		delete(accounts, account)
+		if len(accounts) == 0 {
+			delete(r.users, email)
+		}
+	}
+}
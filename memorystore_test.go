@@ -0,0 +1,179 @@
+package cm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStoreEmpty(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r := NewMemoryStore()
+	pk := ts.PublicKey(t, ts.CreateAccountPair(t))
+	d, err := r.GetConfig(pk)
+	require.NoError(t, err)
+	require.Nil(t, d)
+
+	d, err = r.GetUserJwt("me@x.y.z", pk)
+	require.NoError(t, err)
+	require.Nil(t, d)
+
+	_, err = r.GetConfig("bad")
+	require.Error(t, err)
+}
+
+func TestMemoryStoreUsers(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r := NewMemoryStore()
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	userToken := ts.CreateUser(t, "Me@X.y.z", akp)
+	require.NoError(t, r.StoreUserJwt([]byte(userToken)))
+
+	// not released without a config listing the user
+	d, err := r.GetUserJwt("me@x.y.z", apk)
+	require.NoError(t, err)
+	require.Nil(t, d)
+
+	var rc ResolverConfig
+	rc.Users = append(rc.Users, ts.MakeUserConfig("me@x.y.z", Owner))
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+
+	accounts, err := r.GetUserAccounts("ME@x.y.z")
+	require.NoError(t, err)
+	require.Equal(t, []string{apk}, accounts)
+
+	d, err = r.GetUserJwt("me@X.Y.Z", apk)
+	require.NoError(t, err)
+	require.Equal(t, userToken, string(d))
+
+	// removing the user from the config deletes the static JWT
+	rc.Users = nil
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	require.Empty(t, r.users)
+
+	accounts, err = r.GetUserAccounts("me@x.y.z")
+	require.NoError(t, err)
+	require.Empty(t, accounts)
+}
+
+func TestMemoryStoreKindChangeDeletesUsers(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r := NewMemoryStore()
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Static)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	_, err := r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	require.NoError(t, r.StoreUserJwt([]byte(ts.CreateUser(t, "a@x.y.z", akp))))
+	require.Len(t, r.users, 1)
+
+	gc := ts.CreateResolverConfig(t, Generator)
+	gc.Users = rc.Users
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, gc, akp)))
+	require.NoError(t, err)
+	require.Empty(t, r.users)
+}
+
+func TestMemoryStoreCredentialsManager(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	var cm CredentialsManager
+	cm.NatsHostPort = ts.ns.ClientURL()
+	cm.Store = NewMemoryStore()
+	require.NoError(t, cm.Run())
+	defer cm.Stop()
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+
+	nc := ts.NatsClient(t, "driver")
+	var uac UpdateAccountRequest
+	uac.Jwt = ts.EncodeResolverConfig(t, rc, akp)
+	r, err := nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, uac), time.Second)
+	require.NoError(t, err)
+	var uar UpdateAccountResponse
+	ts.FromJSON(t, r.Data, &uar)
+	require.Empty(t, uar.Error)
+
+	ureq := UserRequest{Email: "a@x.y.z", Account: ts.PublicKey(t, akp)}
+	r, err = nc.Request(SubjGetUserJwt, ts.ToJSON(t, ureq), time.Second)
+	require.NoError(t, err)
+	var uresp UserResponse
+	ts.FromJSON(t, r.Data, &uresp)
+	require.NotEmpty(t, uresp.Jwt)
+}
+
+func TestMemoryStoreRevisions(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r := NewMemoryStore()
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	var rc ResolverConfig
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	first := ts.EncodeResolverConfig(t, rc, akp)
+	_, err := r.StoreAccountConfig([]byte(first))
+	require.NoError(t, err)
+	rc.Users = nil
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+
+	revisions, err := r.ListConfigRevisions(apk)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+
+	c, err := r.RollbackConfig(apk, 1)
+	require.NoError(t, err)
+	require.True(t, c.HasUser("a@x.y.z"))
+	d, err := r.GetConfig(apk)
+	require.NoError(t, err)
+	require.Equal(t, first, string(d))
+	accounts, err := r.GetUserAccounts("a@x.y.z")
+	require.NoError(t, err)
+	require.Equal(t, []string{apk}, accounts)
+
+	d, err = r.GetConfigRevision(apk, 3)
+	require.NoError(t, err)
+	require.Equal(t, first, string(d))
+	d, err = r.GetConfigRevision(apk, 4)
+	require.NoError(t, err)
+	require.Nil(t, d)
+	_, err = r.RollbackConfig(apk, 4)
+	require.Error(t, err)
+}
+
+func TestMemoryStoreRejectsReplays(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r := NewMemoryStore()
+	akp := ts.CreateAccountPair(t)
+	var rc ResolverConfig
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	first := ts.EncodeResolverConfig(t, rc, akp)
+	_, err := r.StoreAccountConfig([]byte(first))
+	require.NoError(t, err)
+	rc.Users = nil
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+
+	// previously accepted revisions are replays
+	_, err = r.StoreAccountConfig([]byte(first))
+	require.Equal(t, ErrReplayedConfig, err)
+	// but can be restored by the owner with a rollback
+	_, err = r.RollbackConfig(ts.PublicKey(t, akp), 1)
+	require.NoError(t, err)
+}
@@ -0,0 +1,117 @@
+package cm
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+// DefaultNonceTTL is how long an issued nonce can be used to
+// prove possession of a user key
+const DefaultNonceTTL = time.Minute
+
+// MaxIssuedNonces is the number of nonces that can be outstanding
+// at once, as anyone can request them
+const MaxIssuedNonces = 10000
+
+// ErrInvalidNonce is returned for nonces that were not issued,
+// have expired or were already used
+var ErrInvalidNonce = errors.New("invalid nonce")
+
+// ErrTooManyNonces is returned when MaxIssuedNonces are outstanding
+var ErrTooManyNonces = errors.New("too many outstanding nonces")
+
+// Nonces issues single use nonces that clients sign with their
+// user key to prove possession of it.
+type Nonces struct {
+	sync.Mutex
+	ttl    time.Duration
+	max    int
+	issued map[string]time.Time
+	// ids of single use tokens until they expire
+	used map[string]time.Time
+}
+
+func NewNonces(ttl time.Duration) *Nonces {
+	var n Nonces
+	n.ttl = ttl
+	n.max = MaxIssuedNonces
+	n.issued = make(map[string]time.Time)
+	n.used = make(map[string]time.Time)
+	return &n
+}
+
+// Issue returns a new nonce, or ErrTooManyNonces if MaxIssuedNonces
+// are outstanding
+func (n *Nonces) Issue() (string, error) {
+	var d [16]byte
+	if _, err := rand.Read(d[:]); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(d[:])
+	now := time.Now()
+	n.Lock()
+	defer n.Unlock()
+	// drop nonces that were never used
+	for k, exp := range n.issued {
+		if now.After(exp) {
+			delete(n.issued, k)
+		}
+	}
+	if len(n.issued) >= n.max {
+		return "", ErrTooManyNonces
+	}
+	n.issued[nonce] = now.Add(n.ttl)
+	return nonce, nil
+}
+
+// consume removes the nonce, returning true if it was issued and has not expired
+func (n *Nonces) consume(nonce string) bool {
+	n.Lock()
+	defer n.Unlock()
+	exp, ok := n.issued[nonce]
+	delete(n.issued, nonce)
+	return ok && !time.Now().After(exp)
+}
+
+// use records the id of a single use token until it expires, returning
+// false if it was already used
+func (n *Nonces) use(id string, expires time.Time) bool {
+	now := time.Now()
+	n.Lock()
+	defer n.Unlock()
+	for k, exp := range n.used {
+		if now.After(exp) {
+			delete(n.used, k)
+		}
+	}
+	if _, ok := n.used[id]; ok {
+		return false
+	}
+	n.used[id] = expires
+	return true
+}
+
+// Verify consumes the nonce and checks that the signature over
+// it was made by the user key. The signature is base64 URL encoded.
+func (n *Nonces) Verify(upk string, nonce string, sig string) error {
+	if !n.consume(nonce) {
+		return ErrInvalidNonce
+	}
+	if !nkeys.IsValidPublicUserKey(upk) {
+		return errors.New("not user key")
+	}
+	kp, err := nkeys.FromPublicKey(upk)
+	if err != nil {
+		return err
+	}
+	d, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return err
+	}
+	return kp.Verify([]byte(nonce), d)
+}
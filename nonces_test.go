@@ -0,0 +1,68 @@
+package cm
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNonces(t *testing.T) {
+	ukp, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	upk, err := ukp.PublicKey()
+	require.NoError(t, err)
+	sign := func(nonce string) string {
+		sig, err := ukp.Sign([]byte(nonce))
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	n := NewNonces(time.Minute)
+	nonce, err := n.Issue()
+	require.NoError(t, err)
+	other, err := n.Issue()
+	require.NoError(t, err)
+	require.NotEqual(t, nonce, other)
+
+	// signature over a different nonce
+	require.Error(t, n.Verify(upk, nonce, sign(other)))
+	// the failed attempt consumed the nonce
+	require.Equal(t, ErrInvalidNonce, n.Verify(upk, nonce, sign(nonce)))
+	require.NoError(t, n.Verify(upk, other, sign(other)))
+
+	n = NewNonces(time.Millisecond)
+	nonce, err = n.Issue()
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	require.Equal(t, ErrInvalidNonce, n.Verify(upk, nonce, sign(nonce)))
+
+	// outstanding nonces are capped until they are used or expire
+	n = NewNonces(10 * time.Millisecond)
+	n.max = 2
+	nonce, err = n.Issue()
+	require.NoError(t, err)
+	_, err = n.Issue()
+	require.NoError(t, err)
+	_, err = n.Issue()
+	require.ErrorIs(t, err, ErrTooManyNonces)
+	require.NoError(t, n.Verify(upk, nonce, sign(nonce)))
+	_, err = n.Issue()
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = n.Issue()
+	require.NoError(t, err)
+}
+
+func TestSingleUseIDs(t *testing.T) {
+	n := NewNonces(time.Minute)
+	require.True(t, n.use("a", time.Now().Add(time.Minute)))
+	require.False(t, n.use("a", time.Now().Add(time.Minute)))
+	require.True(t, n.use("b", time.Now().Add(time.Millisecond)))
+	time.Sleep(5 * time.Millisecond)
+	// expired ids are forgotten, the token can't be used anyway
+	require.True(t, n.use("c", time.Now().Add(time.Minute)))
+	require.NotContains(t, n.used, "b")
+}
@@ -0,0 +1,338 @@
+package cm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWKSRefreshInterval is the minimum time between reloads of the JWKS
+// when an ID token is signed by an unknown key
+const JWKSRefreshInterval = time.Minute
+
+// OIDCVerifier verifies OIDC ID tokens signed with RS256, RS384, RS512,
+// ES256, ES384 or ES512 by a key in the JWKS. The token must be issued
+// by the issuer for the audience, and assert a verified email.
+type OIDCVerifier struct {
+	sync.Mutex
+	issuer   string
+	audience string
+	// jwks is the URL or path of the key set
+	jwks     string
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+func NewOIDCVerifier(issuer string, audience string, jwks string) (*OIDCVerifier, error) {
+	if issuer == "" || audience == "" || jwks == "" {
+		return nil, errors.New("oidc issuer, audience and jwks are required")
+	}
+	var v OIDCVerifier
+	v.issuer = issuer
+	v.audience = audience
+	v.jwks = jwks
+	keys, err := v.load()
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.loadedAt = time.Now()
+	return &v, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid ec key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(d), nil
+}
+
+// load reads the key set, ignoring keys that are not for signatures
+// or that are not supported. It doesn't hold the lock, as fetching the
+// key set can take a while.
+func (v *OIDCVerifier) load() (map[string]crypto.PublicKey, error) {
+	var d []byte
+	var err error
+	if strings.HasPrefix(v.jwks, "https://") || strings.HasPrefix(v.jwks, "http://") {
+		d, err = fetch(v.jwks)
+	} else {
+		d, err = os.ReadFile(v.jwks)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading jwks: %v", err)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(d, &set); err != nil {
+		return nil, fmt.Errorf("error parsing jwks: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pk
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no usable keys")
+	}
+	return keys, nil
+}
+
+func fetch(url string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	r, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, r.Status)
+	}
+	return io.ReadAll(r.Body)
+}
+
+// key returns the key with the id, reloading the key set if the key
+// is not known and the set wasn't reloaded recently
+func (v *OIDCVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.Lock()
+	pk, ok := v.keys[kid]
+	reload := !ok && time.Since(v.loadedAt) > JWKSRefreshInterval
+	if reload {
+		// other unknown keys wait for the next interval, even if this fails
+		v.loadedAt = time.Now()
+	}
+	v.Unlock()
+	if reload {
+		keys, err := v.load()
+		if err != nil {
+			return nil, err
+		}
+		v.Lock()
+		v.keys = keys
+		v.Unlock()
+		pk, ok = keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return pk, nil
+}
+
+type idTokenClaims struct {
+	Issuer        string          `json:"iss"`
+	Audience      json.RawMessage `json:"aud"`
+	Expires       int64           `json:"exp"`
+	NotBefore     int64           `json:"nbf"`
+	Email         string          `json:"email"`
+	EmailVerified interface{}     `json:"email_verified"`
+}
+
+// hasAudience returns true if the audience claim, a string or a list, includes aud
+func (c *idTokenClaims) hasAudience(aud string) bool {
+	var one string
+	if err := json.Unmarshal(c.Audience, &one); err == nil {
+		return one == aud
+	}
+	var list StringList
+	if err := json.Unmarshal(c.Audience, &list); err == nil {
+		return list.Contains(aud)
+	}
+	return false
+}
+
+// emailVerified returns true if email_verified is set, some providers
+// send it as a string
+func (c *idTokenClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	default:
+		return false
+	}
+}
+
+func (v *OIDCVerifier) VerifyIdentity(token string) (string, error) {
+	chunks := strings.Split(token, ".")
+	if len(chunks) != 3 {
+		return "", errors.New("expected 3 chunks")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(chunks[0], &header); err != nil {
+		return "", err
+	}
+	pk, err := v.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(chunks[2], "="))
+	if err != nil {
+		return "", err
+	}
+	if err := verifySignature(header.Alg, pk, []byte(chunks[0]+"."+chunks[1]), sig); err != nil {
+		return "", err
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(chunks[1], &claims); err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	switch {
+	case claims.Issuer != v.issuer:
+		return "", fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case !claims.hasAudience(v.audience):
+		return "", errors.New("unexpected audience")
+	case claims.Expires == 0 || now > claims.Expires:
+		return "", errors.New("id token is expired")
+	case claims.NotBefore > 0 && claims.NotBefore > now:
+		return "", errors.New("id token is not yet valid")
+	case claims.Email == "":
+		return "", errors.New("id token has no email")
+	case !claims.emailVerified():
+		return "", errors.New("id token email is not verified")
+	}
+	return strings.ToLower(claims.Email), nil
+}
+
+func decodeSegment(s string, o interface{}) error {
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, o)
+}
+
+// ecCurves are the curves of the ES algorithms
+var ecCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+func verifySignature(alg string, pk crypto.PublicKey, signed []byte, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		h := sha256.Sum256(signed)
+		digest = h[:]
+	case crypto.SHA384:
+		h := sha512.Sum384(signed)
+		digest = h[:]
+	default:
+		h := sha512.Sum512(signed)
+		digest = h[:]
+	}
+
+	switch k := pk.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return fmt.Errorf("algorithm %q doesn't match the key", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' || k.Curve != ecCurves[alg] {
+			return fmt.Errorf("algorithm %q doesn't match the key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key")
+	}
+}
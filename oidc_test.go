@@ -0,0 +1,200 @@
+package cm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testIdP is a local stand-in for an OIDC provider
+type testIdP struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	var idp testIdP
+	var err error
+	idp.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	idp.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &idp
+}
+
+func (idp *testIdP) JWKS(t *testing.T) []byte {
+	enc := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": enc(idp.rsa.N), "e": enc(big.NewInt(int64(idp.rsa.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": enc(idp.ec.X), "y": enc(idp.ec.Y)},
+	}
+	d, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, err)
+	return d
+}
+
+func (idp *testIdP) WriteJWKS(t *testing.T, dir string) string {
+	fp := filepath.Join(dir, "jwks.json")
+	require.NoError(t, os.WriteFile(fp, idp.JWKS(t), 0600))
+	return fp
+}
+
+// Sign returns an ID token signed with the "rsa" or "ec" key
+func (idp *testIdP) Sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if kid == "ec" {
+		alg = "ES256"
+	}
+	seg := func(o interface{}) string {
+		d, err := json.Marshal(o)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(d)
+	}
+	signed := seg(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + seg(claims)
+	h := sha256.Sum256([]byte(signed))
+	var sig []byte
+	if kid == "ec" {
+		r, s, err := ecdsa.Sign(rand.Reader, idp.ec, h[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	} else {
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, idp.rsa, crypto.SHA256, h[:])
+		require.NoError(t, err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func idTokenClaimsFor(email string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            "https://idp.example.com",
+		"aud":            "dashboard",
+		"sub":            "1234",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"email":          email,
+		"email_verified": true,
+	}
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	idp := newTestIdP(t)
+	v, err := NewOIDCVerifier("https://idp.example.com", "dashboard", idp.WriteJWKS(t, t.TempDir()))
+	require.NoError(t, err)
+
+	claims := idTokenClaimsFor("A@x.y.z")
+	for _, kid := range []string{"rsa", "ec"} {
+		email, err := v.VerifyIdentity(idp.Sign(t, kid, claims))
+		require.NoError(t, err)
+		require.Equal(t, "a@x.y.z", email)
+	}
+
+	claims["aud"] = []string{"other", "dashboard"}
+	_, err = v.VerifyIdentity(idp.Sign(t, "rsa", claims))
+	require.NoError(t, err)
+
+	bad := func(k string, value interface{}) {
+		c := idTokenClaimsFor("a@x.y.z")
+		c[k] = value
+		_, err := v.VerifyIdentity(idp.Sign(t, "rsa", c))
+		require.Error(t, err, k)
+	}
+	bad("iss", "https://other.example.com")
+	bad("aud", "other")
+	bad("exp", time.Now().Add(-time.Minute).Unix())
+	bad("email_verified", false)
+	bad("email", "")
+
+	// tampered payload
+	token := idp.Sign(t, "ec", idTokenClaimsFor("a@x.y.z"))
+	other := idp.Sign(t, "ec", idTokenClaimsFor("b@x.y.z"))
+	chunks := strings.Split(token, ".")
+	_, err = v.VerifyIdentity(chunks[0] + "." + strings.Split(other, ".")[1] + "." + chunks[2])
+	require.Error(t, err)
+
+	// signed by a key not in the set
+	_, err = v.VerifyIdentity(newTestIdP(t).Sign(t, "rsa", idTokenClaimsFor("a@x.y.z")))
+	require.Error(t, err)
+}
+
+func TestOIDCVerifierURL(t *testing.T) {
+	idp := newTestIdP(t)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(idp.JWKS(t))
+	}))
+	defer hs.Close()
+
+	v, err := NewOIDCVerifier("https://idp.example.com", "dashboard", hs.URL)
+	require.NoError(t, err)
+	email, err := v.VerifyIdentity(idp.Sign(t, "rsa", idTokenClaimsFor("a@x.y.z")))
+	require.NoError(t, err)
+	require.Equal(t, "a@x.y.z", email)
+}
+
+func TestOIDCVerifierCurveMatchesAlgorithm(t *testing.T) {
+	idp := newTestIdP(t)
+	signed := []byte("header.payload")
+	// a P-256 signature over a SHA-512 digest, as ES512 would hash it
+	h := sha512.Sum512(signed)
+	r, s, err := ecdsa.Sign(rand.Reader, idp.ec, h[:])
+	require.NoError(t, err)
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	require.Error(t, verifySignature("ES512", &idp.ec.PublicKey, signed, sig))
+}
+
+func TestOIDCVerifierReloadDoesntBlock(t *testing.T) {
+	idp := newTestIdP(t)
+	release := make(chan struct{})
+	var loads int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&loads, 1) > 1 {
+			<-release
+		}
+		w.Write(idp.JWKS(t))
+	}))
+	defer hs.Close()
+	defer close(release)
+
+	v, err := NewOIDCVerifier("https://idp.example.com", "dashboard", hs.URL)
+	require.NoError(t, err)
+	v.Lock()
+	v.loadedAt = time.Now().Add(-2 * JWKSRefreshInterval)
+	v.Unlock()
+
+	// a token with an unknown key reloads the key set
+	done := make(chan struct{})
+	go func() {
+		v.VerifyIdentity(idp.Sign(t, "new", idTokenClaimsFor("a@x.y.z")))
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&loads) == 2 }, time.Second, 10*time.Millisecond)
+
+	// tokens signed by known keys are verified meanwhile
+	_, err = v.VerifyIdentity(idp.Sign(t, "rsa", idTokenClaimsFor("a@x.y.z")))
+	require.NoError(t, err)
+	select {
+	case <-done:
+		t.Fatal("reload finished before the jwks was served")
+	default:
+	}
+}
@@ -4,14 +4,26 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/nats-io/jwt"
+	jwtv2 "github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nkeys"
 )
 
 const DashboardConfigurationType = "dashboard-account-configuration"
 
+// DashboardConfigurationRequestType is the type of requests listing,
+// getting and rolling back configuration revisions
+const DashboardConfigurationRequestType = "dashboard-account-configuration-request"
+
+// DashboardConfigurationJwtType is the type of requests for the
+// configuration JWT, which includes the generator signing key seeds
+const DashboardConfigurationJwtType = "dashboard-account-configuration-jwt"
+
 type ResolverType int
 
 const (
@@ -21,6 +33,12 @@ const (
 
 const Unknown = "unknown"
 
+// ErrConfigExpired is returned for configurations past their `exp`
+var ErrConfigExpired = errors.New("configuration is expired")
+
+// ErrConfigNotYetValid is returned for configurations before their `nbf`
+var ErrConfigNotYetValid = errors.New("configuration is not yet valid")
+
 func (rt ResolverType) String() string {
 	switch rt {
 	case Static:
@@ -32,26 +50,56 @@ func (rt ResolverType) String() string {
 	}
 }
 
-type UserRole int
+// UserRole names a role defined by the generator configuration. Roles
+// in earlier configurations were numbered, 1, 2 and 3 still decode as
+// Owner, Manager and Monitor.
+type UserRole string
 
 const (
-	// Default is no role - static user JWT
-	Owner UserRole = iota + 1
-	Manager
-	Monitor
+	Owner   UserRole = "owner"
+	Manager UserRole = "manager"
+	Monitor UserRole = "monitor"
 )
 
+// numberedRoles are the roles of earlier configurations by number
+var numberedRoles = []UserRole{Owner, Manager, Monitor}
+
+var roleName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 func (ur UserRole) String() string {
-	switch ur {
-	case Owner:
-		return "owner"
-	case Manager:
-		return "manager"
-	case Monitor:
-		return "manager"
-	default:
+	if ur == "" {
 		return Unknown
 	}
+	return string(ur)
+}
+
+func (ur *UserRole) UnmarshalJSON(d []byte) error {
+	var n int
+	if err := json.Unmarshal(d, &n); err == nil {
+		switch {
+		case n == 0:
+			*ur = ""
+		case n > 0 && n <= len(numberedRoles):
+			*ur = numberedRoles[n-1]
+		default:
+			return fmt.Errorf("unknown role %d", n)
+		}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(d, &s); err != nil {
+		return err
+	}
+	*ur = UserRole(s)
+	return nil
+}
+
+// Validate returns an error if the role name is not valid
+func (ur UserRole) Validate() error {
+	if !roleName.MatchString(string(ur)) || ur == Unknown {
+		return fmt.Errorf("invalid role %q", string(ur))
+	}
+	return nil
 }
 
 type Users []User
@@ -85,6 +133,7 @@ type ResolverConfig struct {
 	Kind            ResolverType `json:"kind"`
 	ResolverOptions interface{}  `json:"options"`
 	Users           Users        `json:"users"`
+	Groups          Groups       `json:"groups,omitempty"`
 }
 
 func (rc *ResolverConfig) OptionsAsGeneratorConfig() *GeneratorConfig {
@@ -121,8 +170,47 @@ func (rc *ResolverConfig) Encode(kp nkeys.KeyPair) (string, error) {
 	return gc.Encode(kp)
 }
 
+// DefaultUserJwtTTL is the lifetime of generated user JWTs when
+// neither the role nor the generator configuration specify one
+const DefaultUserJwtTTL = 24 * time.Hour
+
 type GeneratorConfig struct {
 	Roles []RolePerms `json:"roles"`
+	// DefaultTTL is the lifetime in seconds of generated user JWTs
+	// for roles that don't specify one
+	DefaultTTL int64 `json:"default_ttl,omitempty"`
+}
+
+// TTL returns the lifetime of user JWTs generated for the role
+func (gc *GeneratorConfig) TTL(rp *RolePerms) time.Duration {
+	if rp.TTL > 0 {
+		return time.Duration(rp.TTL) * time.Second
+	}
+	if gc.DefaultTTL > 0 {
+		return time.Duration(gc.DefaultTTL) * time.Second
+	}
+	return DefaultUserJwtTTL
+}
+
+// builtinRanks are the ranks of the built-in roles that don't set one
+var builtinRanks = map[UserRole]int{Owner: 30, Manager: 20, Monitor: 10}
+
+// Stronger returns true if role a has a higher rank than role b. Roles
+// that are not defined are the weakest.
+func (gc *GeneratorConfig) Stronger(a UserRole, b UserRole) bool {
+	return gc.rank(a) > gc.rank(b)
+}
+
+// rank returns the rank of the role, or -1 if it is not defined
+func (gc *GeneratorConfig) rank(ur UserRole) int {
+	rp := gc.GetRole(ur)
+	if rp == nil {
+		return -1
+	}
+	if rp.Rank == 0 {
+		return builtinRanks[ur]
+	}
+	return rp.Rank
 }
 
 func (gc *GeneratorConfig) GetRole(ur UserRole) *RolePerms {
@@ -143,110 +231,440 @@ func (gc *GeneratorConfig) Validate() error {
 	if len(gc.Roles) == 0 {
 		return errors.New("invalid role count")
 	}
+	if gc.DefaultTTL < 0 {
+		return errors.New("default ttl cannot be negative")
+	}
 	rk := make(map[UserRole]UserRole)
 	keys := make(map[string]string)
 	for _, i := range gc.Roles {
-		n := i.Role.String()
-		if n == Unknown {
-			return fmt.Errorf("invalid role")
+		if err := i.Role.Validate(); err != nil {
+			return err
 		}
 		_, found := rk[i.Role]
 		if found {
 			return fmt.Errorf("role %s is multiply defined", i.Role.String())
 		}
-		kp, err := nkeys.FromSeed([]byte(i.SigningKey))
+		rk[i.Role] = i.Role
+		pk, err := i.PublicKey()
 		if err != nil {
-			return err
+			return fmt.Errorf("role %s: %v", i.Role.String(), err)
 		}
-		if err := nkeys.CompatibleKeyPair(kp, nkeys.PrefixByteSeed, nkeys.PrefixByteAccount); err != nil {
-			return fmt.Errorf("%q is not a valid signing key", i.SigningKey)
-		}
-		_, found = keys[i.SigningKey]
+		_, found = keys[pk]
 		if found {
-			return fmt.Errorf("signing key %s is multiply defined", i.SigningKey)
+			return fmt.Errorf("signing key %s is multiply defined", pk)
+		}
+		keys[pk] = pk
+		if i.TTL < 0 {
+			return fmt.Errorf("role %s ttl cannot be negative", i.Role.String())
+		}
+		if i.Rank < 0 {
+			return fmt.Errorf("role %s rank cannot be negative", i.Role.String())
+		}
+		if err := i.validatePermissions(); err != nil {
+			return fmt.Errorf("role %s: %v", i.Role.String(), err)
 		}
 	}
 	return nil
 }
 
 type RolePerms struct {
-	Role       UserRole `json:"role"`
-	SigningKey string   `json:"signing_key"`
-	Pub        []string `json:"pub_permissions"`
-	Sub        []string `json:"sub_permissions"`
+	Role UserRole `json:"role"`
+	// Rank decides which role applies to users assigned several, the
+	// highest wins. Unset, owner, manager and monitor rank 30, 20 and
+	// 10, and other roles 0.
+	Rank       int    `json:"rank,omitempty"`
+	SigningKey string `json:"signing_key,omitempty"`
+	// SealedSigningKey is the signing key seed sealed for the curve key
+	// of the credentials manager, and is used instead of SigningKey
+	SealedSigningKey *SealedSeed `json:"sealed_signing_key,omitempty"`
+	// ExternalSigningKey is a signing key held by the Signer of the
+	// credentials manager, and is used instead of SigningKey
+	ExternalSigningKey *ExternalKey `json:"external_signing_key,omitempty"`
+	// Pub, Sub and their deny lists can use the template variables
+	// {{email}}, {{email_hash}}, {{account}} and {{user_pubkey}}
+	Pub     []string `json:"pub_permissions"`
+	Sub     []string `json:"sub_permissions"`
+	PubDeny []string `json:"pub_deny,omitempty"`
+	SubDeny []string `json:"sub_deny,omitempty"`
+	// Resp allows publishing to the reply subjects of received requests
+	Resp *jwtv2.ResponsePermission `json:"resp,omitempty"`
+	// Limits are the subscription, data, payload, source network and
+	// time of day limits of the user
+	Limits RoleLimits `json:"limits,omitempty"`
+	Tags   []string   `json:"tags,omitempty"`
+	// TTL is the lifetime in seconds of user JWTs generated for the role
+	TTL int64 `json:"ttl,omitempty"`
+	// Creds issues full credentials (JWT and seed) instead of bearer JWTs
+	Creds bool `json:"creds,omitempty"`
+}
+
+// RoleLimits are the user limits of a role. Subs, Data and Payload
+// are unlimited when zero.
+type RoleLimits struct {
+	Subs    int64 `json:"subs,omitempty"`
+	Data    int64 `json:"data,omitempty"`
+	Payload int64 `json:"payload,omitempty"`
+	// Src lists the networks users can connect from, as a list or a
+	// comma separated string of CIDRs
+	Src   jwtv2.CIDRList    `json:"src,omitempty"`
+	Times []jwtv2.TimeRange `json:"times,omitempty"`
+	// Max is the v1 limit of earlier configurations, which the server
+	// ignores, so roles setting it are rejected rather than unlimited
+	Max int64 `json:"max,omitempty"`
+}
+
+// Validate rejects limits that user JWTs can't enforce
+func (l RoleLimits) Validate() error {
+	if l.Max != 0 {
+		return errors.New("limits max is not enforced by the server, use subs, data or payload")
+	}
+	if l.Subs < 0 || l.Data < 0 || l.Payload < 0 {
+		return errors.New("limits cannot be negative")
+	}
+	return nil
+}
+
+// natsLimit returns the limit, or no limit if zero
+func natsLimit(v int64) int64 {
+	if v == 0 {
+		return jwtv2.NoLimit
+	}
+	return v
 }
 
 func (rp *RolePerms) KeyPair() (nkeys.KeyPair, error) {
 	return nkeys.FromSeed([]byte(rp.SigningKey))
 }
 
+// PublicKey returns the public key of the signing key, which can be
+// sealed or external
+func (rp *RolePerms) PublicKey() (string, error) {
+	n := 0
+	for _, set := range []bool{rp.SigningKey != "", rp.SealedSigningKey != nil, rp.ExternalSigningKey != nil} {
+		if set {
+			n++
+		}
+	}
+	switch {
+	case n > 1:
+		return "", fmt.Errorf("signing key, sealed signing key and external signing key are exclusive")
+	case rp.SealedSigningKey != nil:
+		if err := rp.SealedSigningKey.Validate(); err != nil {
+			return "", err
+		}
+		return rp.SealedSigningKey.PublicKey, nil
+	case rp.ExternalSigningKey != nil:
+		if err := rp.ExternalSigningKey.Validate(); err != nil {
+			return "", err
+		}
+		return rp.ExternalSigningKey.PublicKey, nil
+	case rp.SigningKey == "":
+		return "", fmt.Errorf("signing key is required")
+	}
+	kp, err := rp.KeyPair()
+	if err != nil {
+		return "", fmt.Errorf("invalid signing key: %v", err)
+	}
+	if err := nkeys.CompatibleKeyPair(kp, nkeys.PrefixByteSeed, nkeys.PrefixByteAccount); err != nil {
+		return "", fmt.Errorf("signing key is not an account seed")
+	}
+	return kp.PublicKey()
+}
+
+// signingKey returns the signing key, opening it with the curve key
+// if it is sealed, or signing with the signer if it is external
+func (rp *RolePerms) signingKey(curve nkeys.KeyPair, signer Signer) (nkeys.KeyPair, error) {
+	if rp.SealedSigningKey != nil {
+		return rp.SealedSigningKey.Open(curve)
+	}
+	if rp.ExternalSigningKey != nil {
+		return rp.ExternalSigningKey.KeyPair(signer)
+	}
+	return rp.KeyPair()
+}
+
+// User returns the permissions and limits of the role, with the
+// subject templates expanded using the values
+func (rp *RolePerms) User(values map[string]string) (jwtv2.User, error) {
+	var u jwtv2.User
+	if err := rp.Limits.Validate(); err != nil {
+		return u, err
+	}
+	var err error
+	if u.Pub.Allow, err = expandSubjects(rp.Pub, values); err != nil {
+		return u, err
+	}
+	if u.Pub.Deny, err = expandSubjects(rp.PubDeny, values); err != nil {
+		return u, err
+	}
+	if u.Sub.Allow, err = expandSubjects(rp.Sub, values); err != nil {
+		return u, err
+	}
+	if u.Sub.Deny, err = expandSubjects(rp.SubDeny, values); err != nil {
+		return u, err
+	}
+	if rp.Resp != nil {
+		resp := *rp.Resp
+		u.Resp = &resp
+	}
+	u.Subs = natsLimit(rp.Limits.Subs)
+	u.Data = natsLimit(rp.Limits.Data)
+	u.Payload = natsLimit(rp.Limits.Payload)
+	u.Src = append(jwtv2.CIDRList{}, rp.Limits.Src...)
+	u.Times = append([]jwtv2.TimeRange(nil), rp.Limits.Times...)
+	return u, nil
+}
+
+// validatePermissions checks the subject templates, and the
+// permissions and limits as they would be issued
+func (rp *RolePerms) validatePermissions() error {
+	for _, list := range [][]string{rp.Pub, rp.Sub, rp.PubDeny, rp.SubDeny} {
+		for _, subj := range list {
+			if err := validateSubjectTemplate(subj); err != nil {
+				return err
+			}
+		}
+	}
+	u, err := rp.User(subjectTemplateValues("user@example.com", "ACCOUNT", "USER"))
+	if err != nil {
+		return err
+	}
+	var vr jwtv2.ValidationResults
+	u.Validate(&vr)
+	if errs := vr.Errors(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
 type Config struct {
-	Account         string
+	Account string
+	// IssuedAt, ID, Expires and NotBefore are copied from the configuration JWT
+	IssuedAt        int64
+	ID              string
+	Expires         int64
+	NotBefore       int64
 	Kind            ResolverType
 	Users           Users
+	Groups          Groups
 	GeneratorConfig *GeneratorConfig
+	// curve opens sealed signing keys
+	curve nkeys.KeyPair
+	// signer signs with external signing keys
+	signer Signer
+}
+
+// SetCurveKey sets the curve key used to open sealed signing keys
+func (c *Config) SetCurveKey(kp nkeys.KeyPair) {
+	c.curve = kp
+}
+
+// SetSigner sets the signer of external signing keys
+func (c *Config) SetSigner(signer Signer) {
+	c.signer = signer
+}
+
+// CheckTimeBounds returns an error if the configuration is expired or not yet valid
+func (c *Config) CheckTimeBounds() error {
+	now := time.Now().Unix()
+	if c.Expires > 0 && now > c.Expires {
+		return ErrConfigExpired
+	}
+	if c.NotBefore > 0 && c.NotBefore > now {
+		return ErrConfigNotYetValid
+	}
+	return nil
 }
 
 func (c *Config) HasUser(email string) bool {
-	return c.getUser(email) != nil
+	_, ok := c.userRole(email)
+	return ok
 }
 
+// userRole returns the effective role of the user, the strongest of its
+// user entry and group memberships, and false if the configuration
+// doesn't include the user
+func (c *Config) userRole(email string) (UserRole, bool) {
+	email = strings.ToLower(email)
+	if IsUserPattern(email) {
+		return "", false
+	}
+	var role UserRole
+	u := c.getUser(email)
+	if u != nil {
+		role = u.Role
+	}
+	if c.GeneratorConfig != nil {
+		if gr := c.Groups.role(email, c.GeneratorConfig.Stronger); c.GeneratorConfig.Stronger(gr, role) {
+			role = gr
+		}
+	}
+	return role, u != nil || role != ""
+}
+
+// getUser returns the user entry for the email. Exact matches win over
+// patterns, and patterns are matched in the order they are listed.
 func (c *Config) getUser(email string) *User {
 	email = strings.ToLower(email)
+	// a pattern is not a user
+	if IsUserPattern(email) {
+		return nil
+	}
+	var match *User
 	for _, e := range c.Users {
-		if strings.ToLower(e.Email) == email {
+		ue := strings.ToLower(e.Email)
+		if ue == email {
 			return &e
 		}
+		if match == nil && IsUserPattern(ue) {
+			if ok, _ := path.Match(ue, email); ok {
+				u := e
+				match = &u
+			}
+		}
+	}
+	return match
+}
+
+// IsUserPattern returns true if the email is a pattern such as
+// `*@example.com` matching multiple users
+func IsUserPattern(email string) bool {
+	return strings.ContainsAny(email, "*?[")
+}
+
+// validateEmail rejects emails that could escape the directories
+// of stores that name files after them
+func validateEmail(email string) error {
+	if email == "" || strings.ContainsAny(email, "/\\\x00") || strings.Contains(email, "..") {
+		return fmt.Errorf("invalid email %q", email)
+	}
+	return nil
+}
+
+func validateUserPattern(email string) error {
+	if _, err := path.Match(email, ""); err != nil || !strings.Contains(email, "@") {
+		return fmt.Errorf("invalid user pattern %q", email)
 	}
 	return nil
 }
 
+// indexKeys returns the emails the configuration lists, with
+// PatternIndexKey standing in for any user patterns
+func (c *Config) indexKeys() StringList {
+	var a StringList
+	for _, e := range c.ListUsers() {
+		if IsUserPattern(e) {
+			a.Add(PatternIndexKey)
+		} else {
+			a.Add(e)
+		}
+	}
+	return a
+}
+
+// ListUsers returns the emails and user patterns listed by the
+// users and groups of the configuration
 func (c *Config) ListUsers() StringList {
 	var a StringList
 	for _, e := range c.Users {
 		a.Add(strings.ToLower(e.Email))
 	}
+	a.Add(c.Groups.members()...)
 	return a
 }
 
 func (c *Config) GetUserJwt(email string) ([]byte, error) {
-	email = strings.ToLower(email)
-	if err := c.Validate(); err != nil {
+	token, _, err := c.GetUserCreds(email, false)
+	return token, err
+}
+
+// GetUserCreds generates a JWT for the user. If creds is set, or the
+// user's role issues credentials, the JWT is not a bearer token and
+// a decorated credentials file with the JWT and user seed is also returned.
+func (c *Config) GetUserCreds(email string, creds bool) ([]byte, []byte, error) {
+	perms, err := c.userPerms(email)
+	if err != nil || perms == nil {
+		return nil, nil, err
+	}
+	creds = creds || perms.Creds
+
+	ukp, err := nkeys.CreateUser()
+	if err != nil {
+		return nil, nil, err
+	}
+	upk, err := ukp.PublicKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := c.issueUserJwt(email, upk, perms, !creds)
+	if err != nil || !creds {
+		return []byte(s), nil, err
+	}
+	seed, err := ukp.Seed()
+	if err != nil {
+		return nil, nil, err
+	}
+	cf, err := jwtv2.FormatUserConfig(s, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(s), cf, nil
+}
+
+// GetUserJwtForKey generates a JWT for the user bound to the
+// specified user public key. The JWT is never a bearer token.
+func (c *Config) GetUserJwtForKey(email string, upk string) ([]byte, error) {
+	if !nkeys.IsValidPublicUserKey(upk) {
+		return nil, fmt.Errorf("%q is not a valid user key", upk)
+	}
+	perms, err := c.userPerms(email)
+	if err != nil || perms == nil {
+		return nil, err
+	}
+	s, err := c.issueUserJwt(email, upk, perms, false)
+	return []byte(s), err
+}
+
+// userPerms returns the role permissions for the user or nil if the
+// configuration doesn't list the user
+func (c *Config) userPerms(email string) (*RolePerms, error) {
+	if err := c.CheckTimeBounds(); err != nil {
 		return nil, err
 	}
 	if c.Kind != Generator {
 		return nil, errors.New("not generator")
 	}
-	u := c.getUser(email)
-	if u == nil {
+	if c.GeneratorConfig == nil {
+		return nil, errors.New("nil generator config")
+	}
+	role, ok := c.userRole(email)
+	if !ok {
 		return nil, nil
 	}
-	perms := c.GeneratorConfig.GetRole(u.Role)
+	perms := c.GeneratorConfig.GetRole(role)
 	if perms == nil {
-		return nil, fmt.Errorf("role not found - %s", u.Role.String())
-	}
-
-	sk, err := nkeys.FromSeed([]byte(perms.SigningKey))
-	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("role not found - %s", role.String())
 	}
+	return perms, nil
+}
 
-	ukp, err := nkeys.CreateUser()
+func (c *Config) issueUserJwt(email string, upk string, perms *RolePerms, bearer bool) (string, error) {
+	sk, err := perms.signingKey(c.curve, c.signer)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	upk, err := ukp.PublicKey()
+	defer sk.Wipe()
+	uc := jwtv2.NewUserClaims(upk)
+	uc.Name = strings.ToLower(email)
+	uc.Expires = time.Now().Add(c.GeneratorConfig.TTL(perms)).Unix()
+	uc.User, err = perms.User(subjectTemplateValues(email, c.Account, upk))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	uc := jwt.NewUserClaims(upk)
-	uc.Name = email
-	uc.BearerToken = true
 	uc.IssuerAccount = c.Account
-	uc.Sub.Allow = append(uc.Sub.Allow, perms.Sub...)
-	uc.Pub.Allow = append(uc.Pub.Allow, perms.Pub...)
-	s, err := uc.Encode(sk)
-	return []byte(s), err
+	uc.BearerToken = bearer
+	uc.Tags.Add(perms.Tags...)
+	return uc.Encode(sk)
 }
 
 func (c *Config) Validate() error {
@@ -260,23 +678,92 @@ func (c *Config) Validate() error {
 	if c.Kind != Generator && c.GeneratorConfig != nil {
 		return fmt.Errorf("non generator configs cannot have a generator")
 	}
+	for _, u := range c.Users {
+		if err := validateEmail(u.Email); err != nil {
+			return err
+		}
+		if !IsUserPattern(u.Email) {
+			continue
+		}
+		if c.Kind != Generator {
+			return fmt.Errorf("user pattern %q requires a generator config", u.Email)
+		}
+		if err := validateUserPattern(u.Email); err != nil {
+			return err
+		}
+	}
+	if len(c.Groups) > 0 {
+		if c.Kind != Generator {
+			return fmt.Errorf("groups require a generator config")
+		}
+		if err := c.Groups.Validate(); err != nil {
+			return err
+		}
+	}
 	if c.Kind == Generator {
 		if c.GeneratorConfig == nil {
 			return fmt.Errorf("nil generator config")
 		}
 		for _, rc := range c.GeneratorConfig.Roles {
-			if c.Account == strings.ToUpper(rc.SigningKey) {
+			if pk, err := rc.PublicKey(); err == nil && c.Account == pk {
 				return fmt.Errorf("generator signing keys cannot be account key")
 			}
 		}
-		return c.GeneratorConfig.Validate()
+		if err := c.GeneratorConfig.Validate(); err != nil {
+			return err
+		}
+		// roles are named by the generator, so catch misspelled ones
+		for _, u := range c.Users {
+			if u.Role != "" && c.GeneratorConfig.GetRole(u.Role) == nil {
+				return fmt.Errorf("user %s has undefined role %s", u.Email, u.Role.String())
+			}
+		}
+		for _, g := range c.Groups {
+			if g.Role != "" && c.GeneratorConfig.GetRole(g.Role) == nil {
+				return fmt.Errorf("group %s has undefined role %s", g.Name, g.Role.String())
+			}
+		}
 	}
 	return nil
 }
 
 // ParseConfig returns a resolver configuration that can be used
-// to resolve credential requests
+// to resolve credential requests. Configurations outside of their
+// `nbf` and `exp` bounds are returned with ErrConfigNotYetValid
+// or ErrConfigExpired.
 func ParseConfig(token []byte) (*Config, error) {
+	c, err := parseConfig(token)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.CheckTimeBounds()
+}
+
+// parseConfig returns a resolver configuration regardless of its time bounds
+func parseConfig(token []byte) (*Config, error) {
+	c, err := decodeConfig(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadConfig returns a stored resolver configuration that can be used
+// to resolve credential requests. Stored configurations were validated
+// when accepted, and are not held to rules added since.
+func loadConfig(token []byte) (*Config, error) {
+	c, err := decodeConfig(token)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.CheckTimeBounds()
+}
+
+// decodeConfig returns the resolver configuration without validating it
+func decodeConfig(token []byte) (*Config, error) {
 	claim, err := jwt.DecodeGeneric(string(token))
 	if err != nil {
 		return nil, err
@@ -302,8 +789,13 @@ func ParseConfig(token []byte) (*Config, error) {
 
 	var config Config
 	config.Account = claim.Issuer
+	config.IssuedAt = claim.IssuedAt
+	config.ID = claim.ID
+	config.Expires = claim.Expires
+	config.NotBefore = claim.NotBefore
 	config.Kind = rc.Kind
 	config.Users = rc.Users
+	config.Groups = rc.Groups
 	if config.Kind == Generator {
 		cc, err := json.Marshal(rc.ResolverOptions)
 		if err != nil {
@@ -315,8 +807,43 @@ func ParseConfig(token []byte) (*Config, error) {
 		}
 		config.GeneratorConfig = &gc
 	}
-	if err := config.Validate(); err != nil {
-		return nil, err
-	}
 	return &config, nil
 }
+
+// rawConfig returns the stored configuration, or if it no longer
+// decodes, the users and groups it lists, so their static user JWTs
+// and index entries can still be removed. It returns nil if the token
+// can't be read at all.
+func rawConfig(token []byte) *Config {
+	if c, err := decodeConfig(token); err == nil {
+		return c
+	}
+	claim, err := jwt.DecodeGeneric(string(token))
+	if err != nil {
+		return nil
+	}
+	d, err := json.Marshal(claim.Data)
+	if err != nil {
+		return nil
+	}
+	var rc struct {
+		Kind  ResolverType `json:"kind"`
+		Users []struct {
+			Email string `json:"email"`
+		} `json:"users"`
+		Groups []struct {
+			Name    string   `json:"name"`
+			Members []string `json:"members"`
+		} `json:"groups"`
+	}
+	// fields that don't decode are left empty
+	json.Unmarshal(d, &rc)
+	c := Config{Account: claim.Issuer, Kind: rc.Kind}
+	for _, u := range rc.Users {
+		c.Users = append(c.Users, User{Email: u.Email})
+	}
+	for _, g := range rc.Groups {
+		c.Groups = append(c.Groups, Group{Name: g.Name, Members: g.Members})
+	}
+	return &c
+}
@@ -1,8 +1,11 @@
 package cm
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
+	jwtv2 "github.com/nats-io/jwt/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -29,3 +32,137 @@ func TestStaticEmptyConfig(t *testing.T) {
 	require.Equal(t, c.Users[0].Role, rc.Users[0].Role)
 	require.Equal(t, c.Users[0].Email, rc.Users[0].Email)
 }
+
+func TestConfigTimeBounds(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+
+	expired := ts.ResolverConfigClaims(t, rc, akp)
+	expired.Expires = time.Now().Add(-time.Minute).Unix()
+	c, err := ParseConfig([]byte(ts.Encode(t, expired, akp)))
+	require.Equal(t, ErrConfigExpired, err)
+	require.NotNil(t, c)
+	_, err = c.GetUserJwt("a@x.y.z")
+	require.Equal(t, ErrConfigExpired, err)
+
+	early := ts.ResolverConfigClaims(t, rc, akp)
+	early.NotBefore = time.Now().Add(time.Minute).Unix()
+	_, err = ParseConfig([]byte(ts.Encode(t, early, akp)))
+	require.Equal(t, ErrConfigNotYetValid, err)
+
+	valid := ts.ResolverConfigClaims(t, rc, akp)
+	valid.NotBefore = time.Now().Add(-time.Minute).Unix()
+	valid.Expires = time.Now().Add(time.Minute).Unix()
+	c, err = ParseConfig([]byte(ts.Encode(t, valid, akp)))
+	require.NoError(t, err)
+	require.Equal(t, valid.Expires, c.Expires)
+}
+
+func TestUserPatterns(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("*@x.y.z", Monitor))
+	rc.Users = append(rc.Users, ts.MakeUserConfig("boss@x.y.z", Owner))
+	rc.Users = append(rc.Users, ts.MakeUserConfig("ops-?@*.x.y.z", Manager))
+	c, err := ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+
+	// exact matches win over patterns
+	require.Equal(t, Owner, c.getUser("Boss@x.y.z").Role)
+	require.Equal(t, Monitor, c.getUser("someone@x.y.z").Role)
+	require.Equal(t, Manager, c.getUser("ops-1@eu.x.y.z").Role)
+	require.Nil(t, c.getUser("someone@a.b.c"))
+	require.Nil(t, c.getUser("someone@eu.x.y.z"))
+	// patterns don't match themselves
+	require.Nil(t, c.getUser("*@x.y.z"))
+	require.Equal(t, StringList{PatternIndexKey, "boss@x.y.z"}, c.indexKeys())
+
+	token, err := c.GetUserJwt("someone@x.y.z")
+	require.NoError(t, err)
+	require.NotNil(t, token)
+
+	// patterns are only supported by generators
+	rc = ts.CreateResolverConfig(t, Static)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("*@x.y.z", Monitor))
+	_, err = ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.Error(t, err)
+
+	rc = ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("[a-@x.y.z", Monitor))
+	_, err = ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.Error(t, err)
+}
+
+func TestCustomRoles(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	var users Users
+	require.NoError(t, json.Unmarshal([]byte(`[{"email":"a@x.y.z","role":1},{"email":"b@x.y.z","role":2},{"email":"c@x.y.z","role":3},{"email":"d@x.y.z","role":"billing"},{"email":"e@x.y.z"}]`), &users))
+	require.Equal(t, []UserRole{Owner, Manager, Monitor, "billing", ""}, []UserRole{users[0].Role, users[1].Role, users[2].Role, users[3].Role, users[4].Role})
+	require.Error(t, json.Unmarshal([]byte(`[{"email":"a@x.y.z","role":4}]`), &users))
+	require.Equal(t, "monitor", Monitor.String())
+
+	var rc ResolverConfig
+	rc.Kind = Generator
+	rc.Users = Users{{Email: "d@x.y.z", Role: "billing"}, {Email: "a@x.y.z", Role: Owner}}
+	rc.Groups = Groups{{Name: "finance", Role: "auditor", Members: []string{"d@x.y.z"}}}
+	var gc GeneratorConfig
+	require.NoError(t, gc.AddRole(ts.MakeRolePerm(t, "billing", []string{"dashboard.billing.>"})))
+	auditor := ts.MakeRolePerm(t, "auditor", []string{"dashboard.audit.>"})
+	auditor.Rank = 5
+	require.NoError(t, gc.AddRole(auditor))
+	require.NoError(t, gc.AddRole(ts.MakeRolePerm(t, Monitor, []string{"dashboard.monitor.>"})))
+	require.NoError(t, gc.AddRole(ts.MakeRolePerm(t, Owner, []string{"dashboard.>"})))
+	rc.ResolverOptions = gc
+
+	c, err := ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, ts.CreateAccountPair(t))))
+	require.NoError(t, err)
+	// higher ranks are stronger, regardless of the order of the roles
+	require.True(t, c.GeneratorConfig.Stronger("auditor", "billing"))
+	require.True(t, c.GeneratorConfig.Stronger("billing", "undefined"))
+	require.False(t, c.GeneratorConfig.Stronger("undefined", "billing"))
+	require.True(t, c.GeneratorConfig.Stronger(Owner, Monitor))
+	require.True(t, c.GeneratorConfig.Stronger(Monitor, "auditor"))
+	require.False(t, c.GeneratorConfig.Stronger("billing", "billing"))
+	role, ok := c.userRole("d@x.y.z")
+	require.True(t, ok)
+	require.Equal(t, UserRole("auditor"), role)
+
+	token, err := c.GetUserJwt("d@x.y.z")
+	require.NoError(t, err)
+	uc, err := jwtv2.DecodeUserClaims(string(token))
+	require.NoError(t, err)
+	require.Equal(t, jwtv2.StringList{"dashboard.audit.>"}, uc.Pub.Allow)
+
+	// roles must be named and defined once, signing keys used once
+	require.Error(t, gc.AddRole(ts.MakeRolePerm(t, "bad role", nil)))
+	gc.Roles = gc.Roles[:4]
+	require.Error(t, gc.AddRole(ts.MakeRolePerm(t, "billing", nil)))
+	gc.Roles = gc.Roles[:4]
+	dup := ts.MakeRolePerm(t, "other", nil)
+	dup.SigningKey = gc.Roles[0].SigningKey
+	require.Error(t, gc.AddRole(dup))
+	gc.Roles = gc.Roles[:4]
+	negative := ts.MakeRolePerm(t, "other", nil)
+	negative.Rank = -1
+	require.Error(t, gc.AddRole(negative))
+	gc.Roles = gc.Roles[:4]
+
+	// users and groups can only have roles the generator defines
+	rc.ResolverOptions = gc
+	rc.Users = Users{{Email: "a@x.y.z", Role: "ownr"}}
+	_, err = ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, ts.CreateAccountPair(t))))
+	require.Error(t, err)
+	rc.Users = Users{{Email: "a@x.y.z", Role: Owner}}
+	rc.Groups = Groups{{Name: "finance", Role: "auditr", Members: []string{"d@x.y.z"}}}
+	_, err = ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, ts.CreateAccountPair(t))))
+	require.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package cm
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nkeys"
+)
+
+// ErrNoCurveKey is returned when a sealed signing key is used but
+// the credentials manager has no curve key to open it
+var ErrNoCurveKey = errors.New("no curve key to open sealed signing keys")
+
+// ErrSealedSigningKey is returned for configurations with sealed
+// signing keys that cannot be opened
+var ErrSealedSigningKey = errors.New("sealed signing key cannot be opened")
+
+// SealedSeed is a signing key seed encrypted for the curve (x25519)
+// key of the credentials manager, so that it is not readable in the
+// configuration JWT.
+type SealedSeed struct {
+	// PublicKey is the public key of the sealed signing key
+	PublicKey string `json:"public_key"`
+	// Recipient is the public curve key of the credentials manager
+	Recipient string `json:"recipient"`
+	// Sender is the public curve key that sealed the seed
+	Sender string `json:"sender"`
+	// Sealed is the base64 encoded sealed seed
+	Sealed string `json:"sealed"`
+}
+
+// SealSeed encrypts the signing key seed for the recipient curve key
+// using a new sender key
+func SealSeed(seed []byte, recipient string) (*SealedSeed, error) {
+	kp, err := nkeys.FromSeed(seed)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	sender, err := nkeys.CreateCurveKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer sender.Wipe()
+	spk, err := sender.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	d, err := sender.Seal(seed, recipient)
+	if err != nil {
+		return nil, err
+	}
+	return &SealedSeed{PublicKey: pk, Recipient: recipient, Sender: spk, Sealed: base64.StdEncoding.EncodeToString(d)}, nil
+}
+
+func (s *SealedSeed) Validate() error {
+	if !nkeys.IsValidPublicAccountKey(s.PublicKey) {
+		return fmt.Errorf("%q is not a valid signing key", s.PublicKey)
+	}
+	if !nkeys.IsValidPublicCurveKey(s.Recipient) || !nkeys.IsValidPublicCurveKey(s.Sender) {
+		return errors.New("sealed signing key has invalid curve keys")
+	}
+	if _, err := base64.StdEncoding.DecodeString(s.Sealed); err != nil {
+		return errors.New("sealed signing key is not base64 encoded")
+	}
+	return nil
+}
+
+// Open decrypts the seed with the curve key, returning the signing key
+func (s *SealedSeed) Open(curve nkeys.KeyPair) (nkeys.KeyPair, error) {
+	if curve == nil {
+		return nil, ErrNoCurveKey
+	}
+	cpk, err := curve.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if cpk != s.Recipient {
+		return nil, fmt.Errorf("signing key %s is sealed for %s", s.PublicKey, s.Recipient)
+	}
+	d, err := base64.StdEncoding.DecodeString(s.Sealed)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := curve.Open(d, s.Sender)
+	if err != nil {
+		return nil, fmt.Errorf("error opening signing key %s: %v", s.PublicKey, err)
+	}
+	kp, err := nkeys.FromSeed(seed)
+	if err != nil {
+		return nil, fmt.Errorf("sealed signing key %s is not a seed", s.PublicKey)
+	}
+	pk, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if pk != s.PublicKey {
+		return nil, fmt.Errorf("sealed signing key doesn't match %s", s.PublicKey)
+	}
+	return kp, nil
+}
@@ -0,0 +1,190 @@
+package cm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwtv2 "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// sealRolePerm replaces the signing key of the role with one sealed
+// for the curve key
+func sealRolePerm(t *testing.T, ts *CredentialsTestSetup, r RolePerms, curve nkeys.KeyPair) RolePerms {
+	sealed, err := SealSeed([]byte(r.SigningKey), ts.PublicKey(t, curve))
+	require.NoError(t, err)
+	r.SigningKey = ""
+	r.SealedSigningKey = sealed
+	return r
+}
+
+func TestSealedSigningKeys(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	curve, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+
+	var rc ResolverConfig
+	rc.Kind = Generator
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+	owner := ts.MakeRolePerm(t, Owner, []string{"dashboard.>"})
+	seed := owner.SigningKey
+	var gc GeneratorConfig
+	require.NoError(t, gc.AddRole(sealRolePerm(t, ts, owner, curve)))
+	rc.ResolverOptions = gc
+
+	token := ts.EncodeResolverConfig(t, rc, ts.CreateAccountPair(t))
+	d, err := json.Marshal(rc)
+	require.NoError(t, err)
+	require.NotContains(t, string(d), seed)
+	require.NotContains(t, token, seed)
+
+	config, err := ParseConfig([]byte(token))
+	require.NoError(t, err)
+	_, err = config.GetUserJwt("a@x.y.c")
+	require.ErrorIs(t, err, ErrNoCurveKey)
+
+	other, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+	config.SetCurveKey(other)
+	_, err = config.GetUserJwt("a@x.y.c")
+	require.Error(t, err)
+
+	config.SetCurveKey(curve)
+	ut, err := config.GetUserJwt("a@x.y.c")
+	require.NoError(t, err)
+	uc, err := jwtv2.DecodeUserClaims(string(ut))
+	require.NoError(t, err)
+	require.Equal(t, gc.Roles[0].SealedSigningKey.PublicKey, uc.Issuer)
+
+	// the sealed seed must match its public key
+	bad := sealRolePerm(t, ts, ts.MakeRolePerm(t, Owner, nil), curve)
+	bad.SealedSigningKey.PublicKey = ts.PublicKey(t, ts.CreateAccountPair(t))
+	_, err = bad.signingKey(curve, nil)
+	require.Error(t, err)
+
+	// a role has either a signing key or a sealed signing key
+	both := sealRolePerm(t, ts, ts.MakeRolePerm(t, Manager, nil), curve)
+	both.SigningKey = ts.SeedKey(t, ts.CreateAccountPair(t))
+	require.Error(t, gc.AddRole(both))
+	gc.Roles = gc.Roles[:1]
+	require.Error(t, gc.AddRole(RolePerms{Role: Manager}))
+	gc.Roles = gc.Roles[:1]
+
+	// the same signing key can't be used sealed and in plaintext
+	owner.Role = Manager
+	err = gc.AddRole(owner)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), seed)
+	gc.Roles = gc.Roles[:1]
+
+	// errors don't include seeds
+	user := ts.MakeRolePerm(t, Monitor, nil)
+	user.SigningKey = ts.SeedKey(t, ts.CreateUserPair(t))
+	err = gc.AddRole(user)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), user.SigningKey)
+}
+
+func TestBackendSealedSigningKeys(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	curve, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+	other, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	var rc ResolverConfig
+	rc.Kind = Generator
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+	var gc GeneratorConfig
+	require.NoError(t, gc.AddRole(sealRolePerm(t, ts, ts.MakeRolePerm(t, Owner, []string{"dashboard.>"}), other)))
+	rc.ResolverOptions = gc
+
+	be := NewBackend(NewMemoryStore())
+	be.SetCurveKey(curve)
+	require.ErrorIs(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))), ErrSealedSigningKey)
+
+	gc.Roles = nil
+	require.NoError(t, gc.AddRole(sealRolePerm(t, ts, ts.MakeRolePerm(t, Owner, []string{"dashboard.>"}), curve)))
+	rc.ResolverOptions = gc
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+	token, _, err := be.GetUserCreds(apk, "a@x.y.c", false)
+	require.NoError(t, err)
+	require.NotNil(t, token)
+
+	// revisions sealed for a previous curve key can't be rolled back to
+	store := NewMemoryStore()
+	be = NewBackend(store)
+	be.SetCurveKey(curve)
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+	gc.Roles = nil
+	require.NoError(t, gc.AddRole(ts.MakeRolePerm(t, Owner, []string{"dashboard.>"})))
+	rc.ResolverOptions = gc
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+	be = NewBackend(store)
+	be.SetCurveKey(other)
+	require.NoError(t, be.Start())
+	err = be.RollbackAccountConfig([]byte(ts.RequestToken(t, akp, DashboardConfigurationRequestType)), 1)
+	require.ErrorIs(t, err, ErrSealedSigningKey)
+	token, _, err = be.GetUserCreds(apk, "a@x.y.c", false)
+	require.NoError(t, err)
+	require.NotNil(t, token)
+}
+
+func TestGetCurveKey(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	curve, err := nkeys.CreateCurveKeys()
+	require.NoError(t, err)
+	seed, err := curve.Seed()
+	require.NoError(t, err)
+	fn := filepath.Join(t.TempDir(), "curve.nk")
+	require.NoError(t, os.WriteFile(fn, append(seed, '\n'), 0600))
+
+	var cm CredentialsManager
+	cm.NatsHostPort = ts.ns.ClientURL()
+	cm.DataDir = ts.dir
+	cm.CurveKeyFile = fn
+	require.NoError(t, cm.Run())
+	defer cm.Stop()
+
+	nc := ts.NatsClient(t, "driver")
+	m, err := nc.Request(SubjGetCurveKey, nil, time.Second*2)
+	require.NoError(t, err)
+	var resp CurveKeyResponse
+	ts.FromJSON(t, m.Data, &resp)
+	require.Empty(t, resp.Error)
+	require.Equal(t, ts.PublicKey(t, curve), resp.PublicKey)
+
+	// sealed seeds for the curve key can be used
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+	gc := rc.ResolverOptions.(GeneratorConfig)
+	for i := range gc.Roles {
+		gc.Roles[i] = sealRolePerm(t, ts, gc.Roles[i], curve)
+	}
+	rc.ResolverOptions = gc
+	m, err = nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, UpdateAccountRequest{Jwt: ts.EncodeResolverConfig(t, rc, akp)}), time.Second*2)
+	require.NoError(t, err)
+	var ur RequestResponse
+	ts.FromJSON(t, m.Data, &ur)
+	require.Empty(t, ur.Error)
+
+	m, err = nc.Request(SubjGetUserJwt, ts.ToJSON(t, UserRequest{Email: "a@x.y.z", Account: ts.PublicKey(t, akp)}), time.Second*2)
+	require.NoError(t, err)
+	var jr UserResponse
+	ts.FromJSON(t, m.Data, &jr)
+	require.Empty(t, jr.Error)
+	require.NotEmpty(t, jr.Jwt)
+}
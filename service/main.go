@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"runtime"
+	"strings"
 
 	"github.com/aricart/cm"
 )
@@ -12,7 +13,26 @@ func main() {
 	flag.StringVar(&server.NatsHostPort, "nats hostport", "localhost:4222", "NATS hostport")
 	flag.StringVar(&server.CredentialsFile, "creds", "", "NATS credentials file")
 	flag.StringVar(&server.DataDir, "data", "", "data directory")
+	flag.BoolVar(&server.JetStream, "jetstream", false, "keep all data in JetStream key-value buckets")
+	flag.StringVar(&server.OIDCIssuer, "oidc-issuer", "", "issuer of accepted OIDC ID tokens")
+	flag.StringVar(&server.OIDCAudience, "oidc-audience", "", "audience of accepted OIDC ID tokens")
+	flag.StringVar(&server.OIDCJWKS, "oidc-jwks", "", "URL or path of the JWKS verifying OIDC ID tokens")
+	flag.StringVar(&server.AccountJwts, "account-jwts", "", "directory, URL or nats[:<subject>] to look up account JWTs verifying generator signing keys")
+	flag.StringVar(&server.CurveKeyFile, "curve-key", "", "file with the curve seed that generator signing keys can be sealed for")
+	flag.StringVar(&server.ExternalSigner, "signer", "", "unix:<path> or nats[:<subject>] of the signer of external generator signing keys")
+	memory := flag.Bool("memory", false, "keep all data in memory")
+	operators := flag.String("trusted-operators", "", "comma separated operator keys, JWTs or JWT files trusted to issue accounts")
+	issuers := flag.String("identity-issuers", "", "comma separated public keys trusted to issue identity assertions")
 	flag.Parse()
+	if *memory {
+		server.Store = cm.NewMemoryStore()
+	}
+	if *operators != "" {
+		server.TrustedOperators = strings.Split(*operators, ",")
+	}
+	if *issuers != "" {
+		server.IdentityIssuers = strings.Split(*issuers, ",")
+	}
 	server.Run()
 	runtime.Goexit()
 }
@@ -0,0 +1,212 @@
+package cm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// DefaultSignerSubject is the subject of the NATS signing service
+const DefaultSignerSubject = "cm.signer.sign"
+
+// ErrNoSigner is returned when a role signs with an external key but
+// the credentials manager has no signer
+var ErrNoSigner = errors.New("no signer for external signing keys")
+
+// Signer signs with keys held outside of the credentials manager, such
+// as in an HSM or a KMS
+type Signer interface {
+	// Sign returns the signature of the data by the key
+	Sign(keyID string, data []byte) ([]byte, error)
+}
+
+// ExternalKey references a signing key held by the Signer
+type ExternalKey struct {
+	// ID identifies the key to the signer, defaults to PublicKey
+	ID string `json:"id,omitempty"`
+	// PublicKey is the public key of the signing key
+	PublicKey string `json:"public_key"`
+}
+
+func (k *ExternalKey) Validate() error {
+	if !nkeys.IsValidPublicAccountKey(k.PublicKey) {
+		return fmt.Errorf("%q is not a valid signing key", k.PublicKey)
+	}
+	return nil
+}
+
+func (k *ExternalKey) keyID() string {
+	if k.ID != "" {
+		return k.ID
+	}
+	return k.PublicKey
+}
+
+// KeyPair returns a key pair that signs with the signer
+func (k *ExternalKey) KeyPair(signer Signer) (nkeys.KeyPair, error) {
+	if signer == nil {
+		return nil, ErrNoSigner
+	}
+	pub, err := nkeys.FromPublicKey(k.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &signerKeyPair{signer: signer, id: k.keyID(), pub: pub}, nil
+}
+
+// signerKeyPair is a nkeys.KeyPair without a seed, delegating signing
+// to a Signer. Signatures are verified against the public key.
+type signerKeyPair struct {
+	signer Signer
+	id     string
+	pub    nkeys.KeyPair
+}
+
+func (kp *signerKeyPair) Seed() ([]byte, error) {
+	return nil, nkeys.ErrPublicKeyOnly
+}
+
+func (kp *signerKeyPair) PublicKey() (string, error) {
+	return kp.pub.PublicKey()
+}
+
+func (kp *signerKeyPair) PrivateKey() ([]byte, error) {
+	return nil, nkeys.ErrPublicKeyOnly
+}
+
+func (kp *signerKeyPair) Sign(input []byte) ([]byte, error) {
+	sig, err := kp.signer.Sign(kp.id, input)
+	if err != nil {
+		return nil, fmt.Errorf("error signing with %s: %v", kp.id, err)
+	}
+	if err := kp.pub.Verify(input, sig); err != nil {
+		return nil, fmt.Errorf("signer returned a bad signature for %s: %v", kp.id, err)
+	}
+	return sig, nil
+}
+
+func (kp *signerKeyPair) Verify(input []byte, sig []byte) error {
+	return kp.pub.Verify(input, sig)
+}
+
+func (kp *signerKeyPair) Wipe() {}
+
+func (kp *signerKeyPair) Seal(input []byte, recipient string) ([]byte, error) {
+	return nil, nkeys.ErrInvalidNKeyOperation
+}
+
+func (kp *signerKeyPair) SealWithRand(input []byte, recipient string, rr io.Reader) ([]byte, error) {
+	return nil, nkeys.ErrInvalidNKeyOperation
+}
+
+func (kp *signerKeyPair) Open(input []byte, sender string) ([]byte, error) {
+	return nil, nkeys.ErrInvalidNKeyOperation
+}
+
+// SignRequest is sent to signers over NATS or a Unix socket
+type SignRequest struct {
+	KeyID string `json:"key_id"`
+	Data  []byte `json:"data"`
+}
+
+// SignResponse is the signer response, an error or the signature
+type SignResponse struct {
+	Sig   []byte `json:"sig,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (r *SignResponse) signature() ([]byte, error) {
+	if r.Error != "" {
+		return nil, errors.New(r.Error)
+	}
+	if len(r.Sig) == 0 {
+		return nil, errors.New("empty signature")
+	}
+	return r.Sig, nil
+}
+
+// NewSigner returns the signer described by the spec: `unix:<path>` for
+// a signing daemon on a Unix socket, or `nats` or `nats:<subject>` for a
+// signing service over the connection.
+func NewSigner(spec string, nc *nats.Conn) (Signer, error) {
+	switch {
+	case strings.HasPrefix(spec, "unix:"):
+		return NewSocketSigner(strings.TrimPrefix(spec, "unix:")), nil
+	case spec == "nats" || strings.HasPrefix(spec, "nats:"):
+		return NewNatsSigner(nc, strings.TrimPrefix(strings.TrimPrefix(spec, "nats"), ":")), nil
+	default:
+		return nil, fmt.Errorf("unknown signer %q", spec)
+	}
+}
+
+// NatsSigner requests signatures from a signing service over NATS
+type NatsSigner struct {
+	nc      *nats.Conn
+	subject string
+	timeout time.Duration
+}
+
+func NewNatsSigner(nc *nats.Conn, subject string) *NatsSigner {
+	if subject == "" {
+		subject = DefaultSignerSubject
+	}
+	return &NatsSigner{nc: nc, subject: subject, timeout: 2 * time.Second}
+}
+
+func (s *NatsSigner) Sign(keyID string, data []byte) ([]byte, error) {
+	req, err := json.Marshal(SignRequest{KeyID: keyID, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.nc.Request(s.subject, req, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	var resp SignResponse
+	if err := json.Unmarshal(m.Data, &resp); err != nil {
+		return nil, err
+	}
+	return resp.signature()
+}
+
+// SocketSigner requests signatures from a signing daemon on a Unix
+// socket. Each request is a line of JSON answered by a line of JSON.
+type SocketSigner struct {
+	path    string
+	timeout time.Duration
+}
+
+func NewSocketSigner(path string) *SocketSigner {
+	return &SocketSigner{path: path, timeout: 2 * time.Second}
+}
+
+func (s *SocketSigner) Sign(keyID string, data []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", s.path, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(conn).Encode(SignRequest{KeyID: keyID, Data: data}); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	var resp SignResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, err
+	}
+	return resp.signature()
+}
@@ -0,0 +1,166 @@
+package cm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jwtv2 "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+// testSigner signs with the keys it holds by ID
+type testSigner map[string]nkeys.KeyPair
+
+func (ks testSigner) Sign(keyID string, data []byte) ([]byte, error) {
+	kp, ok := ks[keyID]
+	if !ok {
+		return nil, errors.New("unknown key")
+	}
+	return kp.Sign(data)
+}
+
+func (ks testSigner) respond(d []byte) []byte {
+	var req SignRequest
+	var resp SignResponse
+	if err := json.Unmarshal(d, &req); err != nil {
+		resp.Error = err.Error()
+	} else if resp.Sig, err = ks.Sign(req.KeyID, req.Data); err != nil {
+		resp.Error = err.Error()
+	}
+	d, _ = json.Marshal(resp)
+	return d
+}
+
+// serveSocket answers sign requests on a Unix socket
+func (ks testSigner) serveSocket(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "signer")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fn := filepath.Join(dir, "signer.sock")
+	l, err := net.Listen("unix", fn)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			line, err := bufio.NewReader(conn).ReadBytes('\n')
+			if err == nil {
+				conn.Write(append(ks.respond(line), '\n'))
+			}
+			conn.Close()
+		}
+	}()
+	return fn
+}
+
+func TestSigners(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	skp := ts.CreateAccountPair(t)
+	ks := testSigner{"role-key": skp}
+
+	nc := ts.NatsClient(t, "signer")
+	_, err := nc.Subscribe(DefaultSignerSubject, func(m *nats.Msg) {
+		m.Respond(ks.respond(m.Data))
+	})
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+
+	for _, spec := range []string{"nats", "unix:" + ks.serveSocket(t)} {
+		signer, err := NewSigner(spec, ts.NatsClient(t, "cm"))
+		require.NoError(t, err, spec)
+		sig, err := signer.Sign("role-key", []byte("hello"))
+		require.NoError(t, err, spec)
+		require.NoError(t, skp.Verify([]byte("hello"), sig), spec)
+		_, err = signer.Sign("other-key", []byte("hello"))
+		require.Error(t, err, spec)
+	}
+	_, err = NewSigner("/some/file", nil)
+	require.Error(t, err)
+}
+
+func TestExternalSigningKeys(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	skp := ts.CreateAccountPair(t)
+	spk := ts.PublicKey(t, skp)
+
+	var rc ResolverConfig
+	rc.Kind = Generator
+	rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.c", Owner))
+	var gc GeneratorConfig
+	require.NoError(t, gc.AddRole(RolePerms{
+		Role:               Owner,
+		ExternalSigningKey: &ExternalKey{ID: "role-key", PublicKey: spk},
+		Pub:                []string{"dashboard.>"},
+		Sub:                []string{"dashboard.>"},
+	}))
+	rc.ResolverOptions = gc
+
+	akp := ts.CreateAccountPair(t)
+	token := ts.EncodeResolverConfig(t, rc, akp)
+	config, err := ParseConfig([]byte(token))
+	require.NoError(t, err)
+	_, err = config.GetUserJwt("a@x.y.c")
+	require.ErrorIs(t, err, ErrNoSigner)
+
+	config.SetSigner(testSigner{"role-key": skp})
+	ut, err := config.GetUserJwt("a@x.y.c")
+	require.NoError(t, err)
+	uc, err := jwtv2.DecodeUserClaims(string(ut))
+	require.NoError(t, err)
+	require.Equal(t, spk, uc.Issuer)
+
+	// signatures by other keys are rejected
+	config.SetSigner(testSigner{"role-key": ts.CreateAccountPair(t)})
+	_, err = config.GetUserJwt("a@x.y.c")
+	require.Error(t, err)
+
+	// the key is referenced by its public key without an ID
+	gc.Roles[0].ExternalSigningKey.ID = ""
+	rc.ResolverOptions = gc
+	config, err = ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	config.SetSigner(testSigner{spk: skp})
+	_, err = config.GetUserJwt("a@x.y.c")
+	require.NoError(t, err)
+
+	// configurations with external keys require a signer
+	store := NewMemoryStore()
+	be := NewBackend(store)
+	require.ErrorIs(t, be.UpdateAccountConfig([]byte(token)), ErrNoSigner)
+	be.SetSigner(testSigner{"role-key": skp})
+	require.NoError(t, be.UpdateAccountConfig([]byte(token)))
+	ut, _, err = be.GetUserCreds(ts.PublicKey(t, akp), "a@x.y.c", false)
+	require.NoError(t, err)
+	require.NotNil(t, ut)
+
+	// and can't be rolled back to without one
+	be = NewBackend(store)
+	require.NoError(t, be.Start())
+	var plain GeneratorConfig
+	require.NoError(t, plain.AddRole(ts.MakeRolePerm(t, Owner, []string{"dashboard.>"})))
+	rc.ResolverOptions = plain
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+	err = be.RollbackAccountConfig([]byte(ts.RequestToken(t, akp, DashboardConfigurationRequestType)), 1)
+	require.ErrorIs(t, err, ErrNoSigner)
+
+	// a role has only one kind of signing key
+	bad := ts.MakeRolePerm(t, Manager, nil)
+	bad.ExternalSigningKey = &ExternalKey{PublicKey: ts.PublicKey(t, ts.CreateAccountPair(t))}
+	require.Error(t, gc.AddRole(bad))
+	gc.Roles = gc.Roles[:1]
+	require.Error(t, gc.AddRole(RolePerms{Role: Manager, ExternalSigningKey: &ExternalKey{PublicKey: "nope"}}))
+}
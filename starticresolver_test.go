@@ -2,6 +2,7 @@ package cm
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -157,3 +158,180 @@ func TestUnsuportedStoreErrors(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "bad configuration")
 }
+
+func TestIndexRebuilt(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r, err := NewStaticResolver(ts.dir)
+	require.NoError(t, err)
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Generator)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("me@x.y.z", Owner))
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+
+	// data directories without an index get one on startup
+	require.NoError(t, os.RemoveAll(filepath.Join(ts.dir, "index")))
+	r, err = NewStaticResolver(ts.dir)
+	require.NoError(t, err)
+	accounts, err := r.GetUserAccounts("me@x.y.z")
+	require.NoError(t, err)
+	require.Equal(t, []string{ts.PublicKey(t, akp)}, accounts)
+}
+
+func TestInterruptedConfigUpdateCompleted(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r, err := NewStaticResolver(ts.dir)
+	require.NoError(t, err)
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	var rc ResolverConfig
+	rc.Users = append(rc.Users, ts.MakeUserConfig("me@x.y.z", Owner))
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	require.NoError(t, r.StoreUserJwt([]byte(ts.CreateUser(t, "me@x.y.z", akp))))
+	fp := filepath.Join(r.calcUserDir("me@x.y.z"), apk)
+	require.FileExists(t, fp)
+
+	// simulate a crash after the intent was recorded
+	rc.Users = nil
+	config := ts.EncodeResolverConfig(t, rc, akp)
+	require.NoError(t, r.writeJournal(configUpdate{
+		Account:     apk,
+		Token:       config,
+		DeleteUsers: Users{ts.MakeUserConfig("me@x.y.z", Owner)},
+		IndexRemove: StringList{"me@x.y.z"},
+	}))
+	// and a temporary journal file that was never renamed
+	require.NoError(t, ioutil.WriteFile(filepath.Join(ts.dir, "journal", ".tmp"), []byte("x"), 0644))
+
+	r, err = NewStaticResolver(ts.dir)
+	require.NoError(t, err)
+	d, err := r.GetConfig(apk)
+	require.NoError(t, err)
+	require.Equal(t, config, string(d))
+	require.NoFileExists(t, fp)
+	accounts, err := r.GetUserAccounts("me@x.y.z")
+	require.NoError(t, err)
+	require.Empty(t, accounts)
+	infos, err := ioutil.ReadDir(filepath.Join(ts.dir, "journal"))
+	require.NoError(t, err)
+	require.Empty(t, infos)
+}
+
+func TestAtomicWriteLeavesNoTemporaryFiles(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r, err := NewStaticResolver(ts.dir)
+	require.NoError(t, err)
+	akp := ts.CreateAccountPair(t)
+	rc := ts.CreateResolverConfig(t, Static)
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+
+	dir := r.calcConfigDir(ts.PublicKey(t, akp))
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, ts.PublicKey(t, akp), infos[0].Name())
+	require.Equal(t, "revisions", infos[1].Name())
+
+	infos, err = ioutil.ReadDir(filepath.Join(dir, "revisions"))
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, "1", infos[0].Name())
+}
+
+func TestEmailsCannotEscapeDataDir(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r, err := NewStaticResolver(ts.dir)
+	require.NoError(t, err)
+	akp := ts.CreateAccountPair(t)
+	for _, email := range []string{"../../../escaped@x", "a/b@x", `a\b@x`} {
+		rc := ts.CreateResolverConfig(t, Static)
+		rc.Users = append(rc.Users, ts.MakeUserConfig(email, Owner))
+		_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+		require.Error(t, err, email)
+		require.Error(t, r.StoreUserJwt([]byte(ts.CreateUser(t, email, akp))), email)
+	}
+
+	// the issuer account names the user JWT file
+	uc := jwt.NewUserClaims(ts.PublicKey(t, ts.CreateUserPair(t)))
+	uc.Name = "a@x.y.z"
+	uc.IssuerAccount = "../../../pwned"
+	require.Error(t, r.StoreUserJwt([]byte(ts.Encode(t, uc, akp))))
+	_, err = os.Stat(filepath.Join(ts.dir, "pwned"))
+	require.True(t, os.IsNotExist(err))
+
+	// index files are named after the encoded email
+	rc := ts.CreateResolverConfig(t, Static)
+	rc.Users = append(rc.Users, ts.MakeUserConfig("me@x.y.z", Owner))
+	_, err = r.StoreAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	matches, err := filepath.Glob(filepath.Join(ts.dir, "index", "*", "*"))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	require.NotContains(t, filepath.Base(matches[0]), "@")
+}
+
+func TestStoredConfigsNotHeldToNewRules(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	r, err := NewStaticResolver(ts.dir)
+	require.NoError(t, err)
+
+	// a generator config accepted before roles had to be defined
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	var rc ResolverConfig
+	rc.Kind = Generator
+	rc.Users = Users{ts.MakeUserConfig("a@x.y.z", Owner), ts.MakeUserConfig("b@x.y.z", Monitor)}
+	rc.ResolverOptions = GeneratorConfig{Roles: []RolePerms{ts.MakeRolePerm(t, Owner, []string{"dashboard.>"})}}
+	legacy := ts.EncodeResolverConfig(t, rc, akp)
+	_, err = ParseConfig([]byte(legacy))
+	require.Error(t, err)
+	require.NoError(t, r.applyConfigUpdate(configUpdate{Account: apk, Token: legacy, Revision: 1, IndexAdd: StringList{"a@x.y.z", "b@x.y.z"}}))
+
+	// a static config that no longer decodes
+	skp := ts.CreateAccountPair(t)
+	spk := ts.PublicKey(t, skp)
+	gc := jwt.NewGenericClaims(spk)
+	gc.Type = DashboardConfigurationType
+	gc.Data = map[string]interface{}{"kind": Static, "users": []interface{}{map[string]interface{}{"email": "s@x.y.z", "role": 4}}}
+	require.NoError(t, r.applyConfigUpdate(configUpdate{Account: spk, Token: ts.Encode(t, gc, skp), Revision: 1, IndexAdd: StringList{"s@x.y.z"}}))
+	require.NoError(t, r.StoreUserJwt([]byte(ts.CreateUser(t, "s@x.y.z", skp))))
+	fp := filepath.Join(r.calcUserDir("s@x.y.z"), spk)
+	require.FileExists(t, fp)
+
+	// the store and the backend still start
+	require.NoError(t, os.RemoveAll(filepath.Join(ts.dir, "index")))
+	r, err = NewStaticResolver(ts.dir)
+	require.NoError(t, err)
+	be := NewBackend(r)
+	require.NoError(t, be.Start())
+	token, _, err := be.GetUserCreds(apk, "a@x.y.z", false)
+	require.NoError(t, err)
+	require.NotNil(t, token)
+	_, _, err = be.GetUserCreds(apk, "b@x.y.z", false)
+	require.Error(t, err)
+
+	// and the configs can be replaced
+	rc.Users = rc.Users[:1]
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+	accounts, err := r.GetUserAccounts("b@x.y.z")
+	require.NoError(t, err)
+	require.Empty(t, accounts)
+
+	require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, ts.CreateResolverConfig(t, Static), skp))))
+	require.NoFileExists(t, fp)
+	accounts, err = r.GetUserAccounts("s@x.y.z")
+	require.NoError(t, err)
+	require.Empty(t, accounts)
+}
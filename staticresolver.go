@@ -2,12 +2,17 @@ package cm
 
 import (
 	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/nats-io/jwt"
 	"github.com/nats-io/nkeys"
@@ -15,6 +20,10 @@ import (
 
 type StaticFileResolver struct {
 	dir string
+	// serializes configuration and user updates per account
+	locks KeyLocks
+	// serializes updates to the email to accounts index
+	indexMu sync.Mutex
 }
 
 func NewStaticResolver(dir string) (*StaticFileResolver, error) {
@@ -28,42 +37,189 @@ func NewStaticResolver(dir string) (*StaticFileResolver, error) {
 
 func (r *StaticFileResolver) init() error {
 	if _, err := os.Stat(r.dir); os.IsNotExist(err) {
-		return os.MkdirAll(r.dir, 0755)
+		if err := os.MkdirAll(r.dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := r.recover(); err != nil {
+		return err
+	}
+	// data directories created before the index existed need one
+	if !r.dirExists(filepath.Join(r.dir, "index")) {
+		return r.reindex()
 	}
 	return nil
 }
 
+// reindex builds the email to accounts index from the stored configurations
+func (r *StaticFileResolver) reindex() error {
+	accounts, err := r.ListAccounts()
+	if err != nil {
+		return err
+	}
+	for _, a := range accounts {
+		d, err := r.GetConfig(a)
+		if err != nil {
+			return err
+		}
+		if d == nil {
+			continue
+		}
+		c := rawConfig(d)
+		if c == nil {
+			continue
+		}
+		if err := r.updateIndex(c.Account, c.indexKeys(), nil); err != nil {
+			return err
+		}
+	}
+	return r.ensureDir(filepath.Join(r.dir, "index"))
+}
+
 func (r *StaticFileResolver) StoreAccountConfig(token []byte) (*Config, error) {
 	nc, err := ParseConfig(token)
 	if err != nil {
 		return nc, err
 	}
-	otoken, err := r.GetConfig(nc.Account)
+	unlock := r.locks.Lock(nc.Account)
+	defer unlock()
+	current, err := r.readConfig(nc.Account)
 	if err != nil {
 		return nc, err
 	}
+	revisions, err := r.configRevisions(nc.Account)
+	if err != nil {
+		return nc, err
+	}
+	if err := checkConfigOrder(nc, token, current, revisions); err != nil {
+		return nc, err
+	}
+	return nc, r.storeConfig(nc, token)
+}
+
+// storeConfig replaces the account configuration and records it as
+// a new revision, the caller is expected to hold the lock for the account
+func (r *StaticFileResolver) storeConfig(nc *Config, token []byte) error {
+	otoken, err := r.readConfig(nc.Account)
+	if err != nil {
+		return err
+	}
 	var oc *Config
 	if otoken != nil {
-		oc, err = ParseConfig(otoken)
-		if err != nil {
-			return nc, err
-		}
+		oc = rawConfig(otoken)
+	}
+	revisions, err := r.listRevisions(nc.Account)
+	if err != nil {
+		return err
+	}
+	u := configUpdate{Account: nc.Account, Token: string(token), Revision: 1}
+	if len(revisions) > 0 {
+		u.Revision = revisions[len(revisions)-1] + 1
 	}
 	// if we have an old static config, but new one is different StoreAccountConfig
 	if oc != nil && oc.Kind == Static {
 		// if changed type delete all users
 		if oc.Kind != nc.Kind {
-			r.deleteUserJwts(oc.Account, oc.Users)
+			u.DeleteUsers = oc.Users
 		} else {
-			deleted := nc.Users.Deleted(oc.Users)
-			r.deleteUserJwts(oc.Account, deleted)
+			u.DeleteUsers = nc.Users.Deleted(oc.Users)
 		}
 	}
-	fp := r.calcConfigDir(nc.Account)
-	if err := r.ensureDir(fp); err != nil {
-		return nc, err
+	u.IndexAdd, u.IndexRemove = indexChanges(oc, nc)
+	// record the intent, so an interrupted update can be completed on restart
+	if err := r.writeJournal(u); err != nil {
+		return err
+	}
+	if err := r.applyConfigUpdate(u); err != nil {
+		return err
+	}
+	return r.removeJournal(u.Account)
+}
+
+// configUpdate describes all the files changed by a configuration update.
+// Every step is idempotent, so it can be re-applied after a crash.
+type configUpdate struct {
+	Account     string     `json:"account"`
+	Token       string     `json:"token"`
+	Revision    int        `json:"revision"`
+	DeleteUsers Users      `json:"delete_users,omitempty"`
+	IndexAdd    StringList `json:"index_add,omitempty"`
+	IndexRemove StringList `json:"index_remove,omitempty"`
+}
+
+func (r *StaticFileResolver) applyConfigUpdate(u configUpdate) error {
+	if err := r.deleteUserJwts(u.Account, u.DeleteUsers); err != nil {
+		return err
+	}
+	fp := r.calcConfigDir(u.Account)
+	rp := filepath.Join(fp, "revisions")
+	if err := r.ensureDir(rp); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(rp, strconv.Itoa(u.Revision)), []byte(u.Token), 0644); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(fp, u.Account), []byte(u.Token), 0644); err != nil {
+		return err
+	}
+	return r.updateIndex(u.Account, u.IndexAdd, u.IndexRemove)
+}
+
+func (r *StaticFileResolver) writeJournal(u configUpdate) error {
+	d, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(r.dir, "journal")
+	if err := r.ensureDir(dir); err != nil {
+		return err
 	}
-	return nc, ioutil.WriteFile(filepath.Join(fp, nc.Account), token, 0644)
+	return writeFileAtomic(filepath.Join(dir, u.Account), d, 0644)
+}
+
+func (r *StaticFileResolver) removeJournal(account string) error {
+	dir := filepath.Join(r.dir, "journal")
+	if err := os.Remove(filepath.Join(dir, account)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// recover completes any configuration updates that were interrupted
+func (r *StaticFileResolver) recover() error {
+	dir := filepath.Join(r.dir, "journal")
+	if !r.dirExists(dir) {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, i := range infos {
+		fp := filepath.Join(dir, i.Name())
+		// an interrupted journal write never started the update
+		if !nkeys.IsValidPublicAccountKey(i.Name()) {
+			if err := os.Remove(fp); err != nil {
+				return err
+			}
+			continue
+		}
+		d, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+		var u configUpdate
+		if err := json.Unmarshal(d, &u); err != nil {
+			return fmt.Errorf("error reading journal %s: %v", fp, err)
+		}
+		if err := r.applyConfigUpdate(u); err != nil {
+			return err
+		}
+		if err := r.removeJournal(u.Account); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (r *StaticFileResolver) StoreUserJwt(token []byte) error {
@@ -76,12 +232,21 @@ func (r *StaticFileResolver) StoreUserJwt(token []byte) error {
 	if uc.IssuerAccount != "" {
 		id = uc.IssuerAccount
 	}
+	// the id names the user JWT, and is not validated by the decoder
+	if !nkeys.IsValidPublicAccountKey(id) {
+		return fmt.Errorf("user JWT issuer account %q is not an account key", id)
+	}
+	unlock := r.locks.Lock(id)
+	defer unlock()
 	// the "email" should be the uc.Name or it won't be found
+	if err := validateEmail(uc.Name); err != nil {
+		return err
+	}
 	fp := r.calcUserDir(uc.Name)
 	if err := r.ensureDir(fp); err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filepath.Join(fp, id), token, 0644)
+	return writeFileAtomic(filepath.Join(fp, id), token, 0644)
 }
 
 func (r *StaticFileResolver) GetConfig(account string) ([]byte, error) {
@@ -89,6 +254,14 @@ func (r *StaticFileResolver) GetConfig(account string) ([]byte, error) {
 	if !nkeys.IsValidPublicAccountKey(account) {
 		return nil, errors.New("not account key")
 	}
+	unlock := r.locks.Lock(account)
+	defer unlock()
+	return r.readConfig(account)
+}
+
+// readConfig returns the configuration for the account, the
+// caller is expected to hold the lock for the account
+func (r *StaticFileResolver) readConfig(account string) ([]byte, error) {
 	dir := r.calcConfigDir(account)
 	d, err := ioutil.ReadFile(filepath.Join(dir, account))
 	if err != nil {
@@ -99,6 +272,103 @@ func (r *StaticFileResolver) GetConfig(account string) ([]byte, error) {
 	return d, err
 }
 
+func (r *StaticFileResolver) ListConfigRevisions(account string) ([]ConfigRevision, error) {
+	account = strings.ToUpper(account)
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return nil, errors.New("not account key")
+	}
+	unlock := r.locks.Lock(account)
+	defer unlock()
+	return r.configRevisions(account)
+}
+
+// configRevisions returns the revisions for the account, the
+// caller is expected to hold the lock for the account
+func (r *StaticFileResolver) configRevisions(account string) ([]ConfigRevision, error) {
+	revisions, err := r.listRevisions(account)
+	if err != nil {
+		return nil, err
+	}
+	var list []ConfigRevision
+	for _, n := range revisions {
+		d, err := r.readRevision(account, n)
+		if err != nil {
+			return nil, err
+		}
+		cr, err := NewConfigRevision(n, d)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, cr)
+	}
+	return list, nil
+}
+
+func (r *StaticFileResolver) GetConfigRevision(account string, revision int) ([]byte, error) {
+	account = strings.ToUpper(account)
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return nil, errors.New("not account key")
+	}
+	unlock := r.locks.Lock(account)
+	defer unlock()
+	return r.readRevision(account, revision)
+}
+
+func (r *StaticFileResolver) RollbackConfig(account string, revision int) (*Config, error) {
+	account = strings.ToUpper(account)
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return nil, errors.New("not account key")
+	}
+	unlock := r.locks.Lock(account)
+	defer unlock()
+	d, err := r.readRevision(account, revision)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, fmt.Errorf("revision %d not found", revision)
+	}
+	c, err := ParseConfig(d)
+	if err != nil {
+		return nil, err
+	}
+	return c, r.storeConfig(c, d)
+}
+
+// listRevisions returns the sorted revision numbers stored for the account
+func (r *StaticFileResolver) listRevisions(account string) ([]int, error) {
+	p := filepath.Join(r.calcConfigDir(account), "revisions")
+	if !r.dirExists(p) {
+		return nil, nil
+	}
+	infos, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	var revisions []int
+	for _, i := range infos {
+		// skips temporary files
+		n, err := strconv.Atoi(i.Name())
+		if err == nil && n > 0 {
+			revisions = append(revisions, n)
+		}
+	}
+	sort.Ints(revisions)
+	return revisions, nil
+}
+
+func (r *StaticFileResolver) readRevision(account string, revision int) ([]byte, error) {
+	fp := filepath.Join(r.calcConfigDir(account), "revisions", strconv.Itoa(revision))
+	d, err := ioutil.ReadFile(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
 func (r *StaticFileResolver) deleteUserJwts(account string, users Users) error {
 	for _, i := range users {
 		if err := r.deleteUserJwt(account, i.Email); err != nil {
@@ -110,18 +380,26 @@ func (r *StaticFileResolver) deleteUserJwts(account string, users Users) error {
 
 func (r *StaticFileResolver) deleteUserJwt(account string, user string) error {
 	dir := r.calcUserDir(user)
-	return os.Remove(filepath.Join(dir, account))
+	if err := os.Remove(filepath.Join(dir, account)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 func (r *StaticFileResolver) GetUserJwt(email string, account string) ([]byte, error) {
 	account = strings.ToUpper(account)
-	ad, err := r.GetConfig(account)
+	if !nkeys.IsValidPublicAccountKey(account) {
+		return nil, errors.New("not account key")
+	}
+	unlock := r.locks.Lock(account)
+	defer unlock()
+	ad, err := r.readConfig(account)
 	if err != nil || ad == nil {
 		if os.IsNotExist(err) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	c, err := ParseConfig(ad)
+	c, err := loadConfig(ad)
 	if err != nil {
 		return nil, err
 	}
@@ -142,28 +420,51 @@ func (r *StaticFileResolver) GetUserJwt(email string, account string) ([]byte, e
 
 func (r *StaticFileResolver) GetUserAccounts(email string) ([]string, error) {
 	email = strings.ToLower(email)
-	p := r.calcUserDir(email)
+	if IsUserPattern(email) {
+		return nil, nil
+	}
+	r.indexMu.Lock()
+	found, err := r.readIndex(email)
+	if err != nil {
+		r.indexMu.Unlock()
+		return nil, err
+	}
+	candidates, err := r.readIndex(PatternIndexKey)
+	r.indexMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := patternAccounts(email, candidates, r.GetConfig)
+	if err != nil {
+		return nil, err
+	}
+	var accounts StringList
+	accounts.Add(found...)
+	accounts.Add(matches...)
+	return accounts, nil
+}
+
+func (r *StaticFileResolver) ListAccounts() ([]string, error) {
+	p := filepath.Join(r.dir, "configs")
 	if !r.dirExists(p) {
 		return nil, nil
 	}
-	infos, err := ioutil.ReadDir(p)
+	shards, err := ioutil.ReadDir(p)
 	if err != nil {
 		return nil, err
 	}
 	var accounts []string
-	for _, i := range infos {
-		n := i.Name()
-		// is this is an account public key
-		if nkeys.IsValidPublicAccountKey(n) {
-			d, err := r.GetConfig(n)
-			if err != nil {
-				return nil, err
-			}
-			c, err := ParseConfig(d)
-			if err != nil {
-				return nil, err
-			}
-			if c.HasUser(email) {
+	for _, s := range shards {
+		if !s.IsDir() {
+			continue
+		}
+		infos, err := ioutil.ReadDir(filepath.Join(p, s.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range infos {
+			n := i.Name()
+			if i.IsDir() && nkeys.IsValidPublicAccountKey(n) {
 				accounts = append(accounts, n)
 			}
 		}
@@ -171,6 +472,66 @@ func (r *StaticFileResolver) GetUserAccounts(email string) ([]string, error) {
 	return accounts, nil
 }
 
+// updateIndex adds and removes the account from the index entries of the emails
+func (r *StaticFileResolver) updateIndex(account string, added StringList, removed StringList) error {
+	r.indexMu.Lock()
+	defer r.indexMu.Unlock()
+	for _, e := range removed {
+		accounts, err := r.readIndex(e)
+		if err != nil {
+			return err
+		}
+		accounts.Remove(account)
+		if err := r.writeIndex(e, accounts); err != nil {
+			return err
+		}
+	}
+	for _, e := range added {
+		accounts, err := r.readIndex(e)
+		if err != nil {
+			return err
+		}
+		accounts.Add(account)
+		if err := r.writeIndex(e, accounts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *StaticFileResolver) readIndex(email string) (StringList, error) {
+	d, err := ioutil.ReadFile(r.calcIndexFile(email))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var accounts StringList
+	if err := json.Unmarshal(d, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (r *StaticFileResolver) writeIndex(email string, accounts StringList) error {
+	fp := r.calcIndexFile(email)
+	if len(accounts) == 0 {
+		if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	d, err := json.Marshal(accounts)
+	if err != nil {
+		return err
+	}
+	if err := r.ensureDir(filepath.Dir(fp)); err != nil {
+		return err
+	}
+	return writeFileAtomic(fp, d, 0644)
+}
+
 func (r *StaticFileResolver) dirExists(v string) bool {
 	i, err := os.Stat(v)
 	if os.IsNotExist(err) {
@@ -183,8 +544,49 @@ func (r *StaticFileResolver) ensureDir(d string) error {
 	return os.MkdirAll(d, 0755)
 }
 
+// writeFileAtomic writes the data to a temporary file that is synced
+// and then renamed into place, so readers and crashes never observe
+// a partially written file
+func writeFileAtomic(fp string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(fp)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(fp)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fp); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes directory entries so renames and removals are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 // calcShard returns a 12 character string on the value specified
-func (r *StaticFileResolver) calcShard(v string) string {
+func calcShard(v string) string {
 	v = strings.ToLower(v)
 	h := sha1.New()
 	h.Write([]byte(v))
@@ -195,11 +597,19 @@ func (r *StaticFileResolver) calcShard(v string) string {
 // calcUserDir returns the dir where the user configuration
 // would be found if it exists
 func (r *StaticFileResolver) calcUserDir(v string) string {
-	return filepath.Join(r.dir, "users", r.calcShard(v), v)
+	return filepath.Join(r.dir, "users", calcShard(v), v)
+}
+
+// calcIndexFile returns the file listing the accounts
+// whose configurations include the email, named after
+// the encoded email
+func (r *StaticFileResolver) calcIndexFile(v string) string {
+	v = strings.ToLower(v)
+	return filepath.Join(r.dir, "index", calcShard(v), base64.RawURLEncoding.EncodeToString([]byte(v)))
 }
 
 // calcConfigDir returns the directory where an account
 // configuration would be found if it exists
 func (r *StaticFileResolver) calcConfigDir(v string) string {
-	return filepath.Join(r.dir, "configs", r.calcShard(v), v)
+	return filepath.Join(r.dir, "configs", calcShard(v), v)
 }
@@ -0,0 +1,144 @@
+package cm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/nats-io/jwt"
+)
+
+// ErrStaleConfig is returned when a configuration was issued
+// before the configuration it would replace
+var ErrStaleConfig = errors.New("configuration is older than the current configuration")
+
+// ErrReplayedConfig is returned when a configuration was already accepted
+var ErrReplayedConfig = errors.New("configuration was already accepted")
+
+// Store is the storage used by the Backend to persist account
+// configurations and static user JWTs.
+type Store interface {
+	// StoreAccountConfig validates and stores an account configuration,
+	// removing any static user JWTs the new configuration no longer lists.
+	// Configurations issued before the current one fail with ErrStaleConfig,
+	// and configurations previously accepted fail with ErrReplayedConfig.
+	StoreAccountConfig(token []byte) (*Config, error)
+	// StoreUserJwt stores a static user JWT for the account that issued it
+	StoreUserJwt(token []byte) error
+	// GetConfig returns the configuration for the account or nil if not found
+	GetConfig(account string) ([]byte, error)
+	// GetUserJwt returns the static user JWT for the email if the
+	// account configuration lists the user, or nil if not found
+	GetUserJwt(email string, account string) ([]byte, error)
+	// GetUserAccounts returns the accounts whose configuration lists the email,
+	// or has a user pattern matching it
+	GetUserAccounts(email string) ([]string, error)
+	// ListAccounts returns the accounts that have a stored configuration
+	ListAccounts() ([]string, error)
+	// ListConfigRevisions returns the stored revisions of the account
+	// configuration, oldest first
+	ListConfigRevisions(account string) ([]ConfigRevision, error)
+	// GetConfigRevision returns the configuration stored as the revision
+	// or nil if not found
+	GetConfigRevision(account string, revision int) ([]byte, error)
+	// RollbackConfig makes the configuration stored as the revision
+	// current again by recording it as a new revision
+	RollbackConfig(account string, revision int) (*Config, error)
+}
+
+// ConfigRevision describes an accepted account configuration
+type ConfigRevision struct {
+	Revision int    `json:"revision"`
+	IssuedAt int64  `json:"iat"`
+	ID       string `json:"jti"`
+	// Hash is the SHA-256 of the configuration JWT
+	Hash string `json:"hash"`
+}
+
+func NewConfigRevision(revision int, token []byte) (ConfigRevision, error) {
+	gc, err := jwt.DecodeGeneric(string(token))
+	if err != nil {
+		return ConfigRevision{}, err
+	}
+	return ConfigRevision{Revision: revision, IssuedAt: gc.IssuedAt, ID: gc.ID, Hash: tokenHash(token)}, nil
+}
+
+func tokenHash(token []byte) string {
+	h := sha256.Sum256(token)
+	return hex.EncodeToString(h[:])
+}
+
+// PatternIndexKey is the index entry listing the accounts whose
+// configurations have user patterns
+const PatternIndexKey = "*"
+
+// patternAccounts returns the accounts whose configuration has a user
+// pattern matching the email, checking the accounts indexed under
+// PatternIndexKey
+func patternAccounts(email string, accounts []string, config func(account string) ([]byte, error)) (StringList, error) {
+	var matches StringList
+	for _, a := range accounts {
+		d, err := config(a)
+		if err != nil {
+			return nil, err
+		}
+		if d == nil {
+			continue
+		}
+		// stored configurations that no longer decode match no one
+		c, err := decodeConfig(d)
+		if err != nil {
+			continue
+		}
+		if c.HasUser(email) {
+			matches.Add(a)
+		}
+	}
+	return matches, nil
+}
+
+// indexChanges returns the emails that need to be added and removed
+// from the email to accounts index when an account configuration
+// is replaced. The old configuration may be nil.
+func indexChanges(oc *Config, nc *Config) (StringList, StringList) {
+	added := nc.indexKeys()
+	if oc == nil {
+		return added, nil
+	}
+	var removed StringList
+	old := oc.indexKeys()
+	for _, e := range old {
+		if !added.Contains(e) {
+			removed.Add(e)
+		}
+	}
+	for _, e := range old {
+		added.Remove(e)
+	}
+	return added, removed
+}
+
+// checkConfigOrder verifies that the new configuration was issued
+// after the current configuration and that it was never accepted before.
+// The jti of a configuration only covers the standard claims, so two
+// configurations issued by an account within the same second share it,
+// the token hash tells them apart.
+func checkConfigOrder(nc *Config, token []byte, current []byte, revisions []ConfigRevision) error {
+	hash := tokenHash(token)
+	if current != nil {
+		oc, err := NewConfigRevision(0, current)
+		if err != nil {
+			return err
+		}
+		if nc.IssuedAt < oc.IssuedAt {
+			return ErrStaleConfig
+		}
+		revisions = append(revisions, oc)
+	}
+	for _, r := range revisions {
+		if nc.ID == r.ID && hash == r.Hash {
+			return ErrReplayedConfig
+		}
+	}
+	return nil
+}
@@ -1,8 +1,12 @@
 package cm
 
-import "strings"
+import (
+	"strings"
+	"sync"
+)
 
 type AccountCache struct {
+	sync.RWMutex
 	emailToAccounts map[string]StringList
 	accountToEmails map[string]StringList
 }
@@ -14,12 +18,25 @@ func NewAccountCache() *AccountCache {
 	return &ac
 }
 
+// Accounts returns a copy of the accounts listing the email
 func (ac *AccountCache) Accounts(email string) []string {
 	email = strings.ToLower(email)
-	return ac.emailToAccounts[email]
+	ac.RLock()
+	defer ac.RUnlock()
+	accounts := ac.emailToAccounts[email]
+	if len(accounts) == 0 {
+		return nil
+	}
+	return append([]string(nil), accounts...)
 }
 
 func (ac *AccountCache) RemoveAll(account string) {
+	ac.Lock()
+	defer ac.Unlock()
+	ac.removeAll(account)
+}
+
+func (ac *AccountCache) removeAll(account string) {
 	account = strings.ToUpper(account)
 	emails := ac.accountToEmails[account]
 	for i, e := range emails {
@@ -29,13 +46,15 @@ func (ac *AccountCache) RemoveAll(account string) {
 	delete(ac.accountToEmails, account)
 	for _, e := range emails {
 		accounts := ac.emailToAccounts[e]
-		accounts.Remove(e)
+		accounts.Remove(account)
 		ac.emailToAccounts[e] = accounts
 	}
 }
 
 func (ac *AccountCache) Update(account string, emails []string) {
-	ac.RemoveAll(account)
+	ac.Lock()
+	defer ac.Unlock()
+	ac.removeAll(account)
 	// add the present
 	list := ac.accountToEmails[account]
 	list.Add(emails...)
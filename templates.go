@@ -0,0 +1,88 @@
+package cm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Template variables expanded in role permission subjects. The email
+// is escaped, as its dots would otherwise add subject tokens.
+const (
+	TemplateEmail     = "email"
+	TemplateEmailHash = "email_hash"
+	TemplateAccount   = "account"
+	TemplateUserKey   = "user_pubkey"
+)
+
+var templateVar = regexp.MustCompile(`{{\s*([^{}\s]*)\s*}}`)
+
+// validateSubjectTemplate returns an error if the subject references
+// unknown template variables or has braces outside of a template variable
+func validateSubjectTemplate(subj string) error {
+	for _, m := range templateVar.FindAllStringSubmatch(subj, -1) {
+		switch m[1] {
+		case TemplateEmail, TemplateEmailHash, TemplateAccount, TemplateUserKey:
+		default:
+			return fmt.Errorf("subject %q has unknown template variable %q", subj, m[1])
+		}
+	}
+	rest := templateVar.ReplaceAllString(subj, "")
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("subject %q has a malformed template", subj)
+	}
+	return nil
+}
+
+// subjectTemplateValues returns the template variables for the user
+func subjectTemplateValues(email string, account string, upk string) map[string]string {
+	email = strings.ToLower(email)
+	h := sha256.Sum256([]byte(email))
+	return map[string]string{
+		TemplateEmail:     escapeToken(email),
+		TemplateEmailHash: hex.EncodeToString(h[:]),
+		TemplateAccount:   account,
+		TemplateUserKey:   upk,
+	}
+}
+
+// escapeToken percent encodes the characters of the value other than
+// letters, digits, `@`, `-`, `_` and `+`, so that it is a single subject
+// token, and different values can't escape to the same token
+func escapeToken(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.IndexByte("@-_+", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// expandSubjects returns the subjects with their template variables
+// replaced. Values that would add tokens, wildcards or spaces to a
+// subject are rejected.
+func expandSubjects(subjects []string, values map[string]string) ([]string, error) {
+	var expanded []string
+	for _, subj := range subjects {
+		var err error
+		s := templateVar.ReplaceAllStringFunc(subj, func(m string) string {
+			v := values[templateVar.FindStringSubmatch(m)[1]]
+			if v == "" || strings.ContainsAny(v, ".*> \t\r\n") {
+				err = fmt.Errorf("cannot expand %q in subject %q", m, subj)
+			}
+			return v
+		})
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, s)
+	}
+	return expanded, nil
+}
@@ -0,0 +1,69 @@
+package cm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	jwtv2 "github.com/nats-io/jwt/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubjectTemplates(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	var rc ResolverConfig
+	rc.Kind = Generator
+	rc.Users = append(rc.Users, ts.MakeUserConfig("A@x.y.z", Owner))
+	var gc GeneratorConfig
+	owner := ts.MakeRolePerm(t, Owner, nil)
+	owner.Pub = []string{"dashboard.users.{{email_hash}}.>", "dashboard.{{ account }}.events"}
+	owner.Sub = []string{"_INBOX.{{user_pubkey}}.>", "dashboard.email.{{email}}"}
+	require.NoError(t, gc.AddRole(owner))
+	rc.ResolverOptions = gc
+
+	akp := ts.CreateAccountPair(t)
+	apk := ts.PublicKey(t, akp)
+	c, err := ParseConfig([]byte(ts.EncodeResolverConfig(t, rc, akp)))
+	require.NoError(t, err)
+	token, err := c.GetUserJwt("a@x.y.z")
+	require.NoError(t, err)
+	uc, err := jwtv2.DecodeUserClaims(string(token))
+	require.NoError(t, err)
+
+	h := sha256.Sum256([]byte("a@x.y.z"))
+	require.Equal(t, jwtv2.StringList{"dashboard.users." + hex.EncodeToString(h[:]) + ".>", "dashboard." + apk + ".events"}, uc.Pub.Allow)
+	require.Equal(t, jwtv2.StringList{"_INBOX." + uc.Subject + ".>", "dashboard.email.a@x%2Ey%2Ez"}, uc.Sub.Allow)
+
+	// bad templates fail validation
+	for _, subj := range []string{"a.{{name}}", "a.{{email}", "a.email}}", "a.{{}}", "a.{{{email}}}"} {
+		bad := ts.MakeRolePerm(t, Manager, []string{subj})
+		var gc GeneratorConfig
+		require.Error(t, gc.AddRole(bad), subj)
+	}
+}
+
+func TestExpandSubjectsRejectsWildcards(t *testing.T) {
+	values := subjectTemplateValues("a*b@x.y.z", "A", "U")
+	for _, v := range []string{"x.y", "x*", ">", "x y"} {
+		values[TemplateAccount] = v
+		_, err := expandSubjects([]string{"dashboard.{{account}}"}, values)
+		require.Error(t, err, v)
+	}
+	s, err := expandSubjects([]string{"dashboard.{{email_hash}}", "dashboard.{{email}}"}, values)
+	require.NoError(t, err)
+	require.Equal(t, "dashboard.a%2Ab@x%2Ey%2Ez", s[1])
+}
+
+func TestEscapedEmailsDontCollide(t *testing.T) {
+	seen := make(map[string]string)
+	for _, email := range []string{"bob@x", "bob@x.com", "bob@x%2Ecom", "a.b@x", "a_b@x", "a%2eb@x", "a b@x", "a>b@x"} {
+		v := escapeToken(email)
+		require.NotContains(t, v, ".", email)
+		require.False(t, strings.ContainsAny(v, "*> \t"), email)
+		require.NotContains(t, seen, v, email)
+		seen[v] = email
+	}
+}
@@ -0,0 +1,58 @@
+package cm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	jwtv2 "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+// ErrUntrustedAccount is returned for accounts whose JWT was not
+// issued by a trusted operator
+var ErrUntrustedAccount = errors.New("account is not issued by a trusted operator")
+
+// TrustedOperators are the operator identity and signing keys that
+// can issue the accounts allowed to push configurations
+type TrustedOperators struct {
+	keys StringList
+}
+
+// NewTrustedOperators returns the trusted operators. Each operator is
+// a public operator key, an operator JWT or the path to an operator
+// JWT. Operator signing keys are only trusted when a JWT is provided.
+func NewTrustedOperators(operators ...string) (*TrustedOperators, error) {
+	var t TrustedOperators
+	for _, o := range operators {
+		o = strings.TrimSpace(o)
+		if nkeys.IsValidPublicOperatorKey(o) {
+			t.keys.Add(o)
+			continue
+		}
+		token := o
+		if d, err := os.ReadFile(o); err == nil {
+			token = strings.TrimSpace(string(d))
+		}
+		oc, err := jwtv2.DecodeOperatorClaims(token)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an operator key, JWT or JWT file: %v", o, err)
+		}
+		t.keys.Add(oc.Subject)
+		t.keys.Add(oc.SigningKeys...)
+	}
+	if len(t.keys) == 0 {
+		return nil, errors.New("no trusted operators")
+	}
+	return &t, nil
+}
+
+// Check returns ErrUntrustedAccount if the account JWT wasn't
+// issued by a trusted operator or operator signing key
+func (t *TrustedOperators) Check(ac *jwtv2.AccountClaims) error {
+	if !t.keys.Contains(ac.Issuer) {
+		return fmt.Errorf("%s: %w", ac.Subject, ErrUntrustedAccount)
+	}
+	return nil
+}
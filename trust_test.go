@@ -0,0 +1,144 @@
+package cm
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	jwtv2 "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedOperators(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	okp, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	osk, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	oc := jwtv2.NewOperatorClaims(ts.PublicKey(t, okp))
+	oc.SigningKeys.Add(ts.PublicKey(t, osk))
+	operatorJwt, err := oc.Encode(okp)
+	require.NoError(t, err)
+	rogue, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	ofp := filepath.Join(dir, "operator.jwt")
+	require.NoError(t, os.WriteFile(ofp, []byte(operatorJwt), 0600))
+
+	var cm CredentialsManager
+	cm.NatsHostPort = ts.ns.ClientURL()
+	cm.Store = NewMemoryStore()
+	cm.AccountJwts = dir
+	cm.TrustedOperators = []string{ofp}
+	require.NoError(t, cm.Run())
+	defer cm.Stop()
+
+	nc := ts.NatsClient(t, "driver")
+	update := func(signer nkeys.KeyPair) int {
+		akp := ts.CreateAccountPair(t)
+		if signer == nil {
+			signer = akp
+		}
+		fp := filepath.Join(dir, ts.PublicKey(t, akp)+".jwt")
+		require.NoError(t, os.WriteFile(fp, []byte(signedAccountJwt(t, ts, akp, signer)), 0600))
+		var uac UpdateAccountRequest
+		uac.Jwt = ts.EncodeResolverConfig(t, ts.CreateResolverConfig(t, Static), akp)
+		r, err := nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, uac), time.Second)
+		require.NoError(t, err)
+		var resp UpdateAccountResponse
+		ts.FromJSON(t, r.Data, &resp)
+		return resp.Code
+	}
+	require.Zero(t, update(okp))
+	require.Zero(t, update(osk))
+	require.Equal(t, http.StatusForbidden, update(rogue))
+	// self-signed
+	require.Equal(t, http.StatusForbidden, update(nil))
+
+	// accounts without a JWT are not trusted either
+	var uac UpdateAccountRequest
+	uac.Jwt = ts.EncodeResolverConfig(t, ts.CreateResolverConfig(t, Static), ts.CreateAccountPair(t))
+	r, err := nc.Request(SubjUpdateAccountConfig, ts.ToJSON(t, uac), time.Second)
+	require.NoError(t, err)
+	var resp UpdateAccountResponse
+	ts.FromJSON(t, r.Data, &resp)
+	require.NotEmpty(t, resp.Error)
+
+	// a bare operator key doesn't trust its signing keys
+	operators, err := NewTrustedOperators(ts.PublicKey(t, okp))
+	require.NoError(t, err)
+	akp := ts.CreateAccountPair(t)
+	ac, err := jwtv2.DecodeAccountClaims(signedAccountJwt(t, ts, akp, osk))
+	require.NoError(t, err)
+	require.ErrorIs(t, operators.Check(ac), ErrUntrustedAccount)
+
+	_, err = NewTrustedOperators("not an operator")
+	require.Error(t, err)
+}
+
+func TestTrustedOperatorsCheckStoredConfigs(t *testing.T) {
+	ts := NewCredentialsTestSetup(t)
+	defer ts.Cleanup(t)
+
+	okp, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	rogue, err := nkeys.CreateOperator()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	src, err := NewDirAccountSource(dir)
+	require.NoError(t, err)
+
+	// configurations stored before the operators were trusted
+	store := NewMemoryStore()
+	be := NewBackend(store)
+	require.NoError(t, be.Start())
+	accounts := map[nkeys.KeyPair]string{}
+	keys := map[nkeys.KeyPair]nkeys.KeyPair{}
+	for _, signer := range []nkeys.KeyPair{okp, rogue} {
+		akp := ts.CreateAccountPair(t)
+		apk := ts.PublicKey(t, akp)
+		keys[signer] = akp
+		rc := ts.CreateResolverConfig(t, Generator)
+		rc.Users = append(rc.Users, ts.MakeUserConfig("a@x.y.z", Owner))
+		require.NoError(t, be.UpdateAccountConfig([]byte(ts.EncodeResolverConfig(t, rc, akp))))
+		fp := filepath.Join(dir, apk+".jwt")
+		require.NoError(t, os.WriteFile(fp, []byte(signedAccountJwt(t, ts, akp, signer)), 0600))
+		accounts[signer] = apk
+	}
+
+	operators, err := NewTrustedOperators(ts.PublicKey(t, okp))
+	require.NoError(t, err)
+	be = NewBackend(store)
+	be.SetAccountJwtSource(src)
+	be.SetTrustedOperators(operators)
+	require.NoError(t, be.Start())
+
+	token, _, err := be.GetUserCreds(accounts[okp], "a@x.y.z", false)
+	require.NoError(t, err)
+	require.NotNil(t, token)
+	_, _, err = be.GetUserCreds(accounts[rogue], "a@x.y.z", false)
+	require.ErrorIs(t, err, ErrUntrustedAccount)
+	_, err = be.GetUserJwtForKey(accounts[rogue], "a@x.y.z", ts.PublicKey(t, ts.CreateUserPair(t)))
+	require.ErrorIs(t, err, ErrUntrustedAccount)
+
+	// the configuration is still returned, flagged as untrusted
+	request := func(akp nkeys.KeyPair) []byte {
+		req := jwt.NewGenericClaims(ts.PublicKey(t, akp))
+		req.Type = DashboardConfigurationType
+		return []byte(ts.Encode(t, req, akp))
+	}
+	v, err := be.GetAccountConfig(request(keys[okp]))
+	require.NoError(t, err)
+	require.NotNil(t, v)
+	v, err = be.GetAccountConfig(request(keys[rogue]))
+	require.ErrorIs(t, err, ErrUntrustedAccount)
+	require.NotErrorIs(t, err, ErrConfigExpired)
+	require.NotNil(t, v)
+}